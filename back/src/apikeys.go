@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// apiKeyPrefix tells API keys apart from session tokens in the Authorization header
+const apiKeyPrefix = "wms2_"
+
+type keyIDT int
+
+type apiKeyScope string
+
+// admin keys can do anything their owner's roles allow
+const (
+	scopeClock apiKeyScope = "clock"
+	scopeRead  apiKeyScope = "read"
+	scopeAdmin apiKeyScope = "admin"
+)
+
+var errUnknownScope = errors.New("unknown scope")
+
+type apiKey struct {
+	ID        keyIDT      `json:"id"`
+	Name      string      `json:"name"`
+	Scope     apiKeyScope `json:"scope"`
+	CreatedAt int         `json:"createdAt"`
+	LastUsed  int         `json:"lastUsed"` // 0 if never used
+}
+
+// allows tells whether a request can be made with a key of the scope,
+// keys can never be used to manage keys so that a leaked one can't be used to make more
+func (s apiKeyScope) allows(method, path string) bool {
+	if path == "/u/keys" || strings.HasPrefix(path, "/u/keys/") ||
+		(strings.HasPrefix(path, "/a/users/") && strings.Contains(path, "/keys")) {
+		return false
+	}
+
+	switch s {
+	case scopeAdmin:
+		return true
+	case scopeRead:
+		return method == http.MethodGet
+	case scopeClock:
+		if method == http.MethodGet && path == "/u/status" {
+			return true
+		}
+		if method != http.MethodPut {
+			return false
+		}
+		// clock keys of users who can clock in others can be used e.g. on a shared kiosk
+		return path == "/u/clock/in" || path == "/u/clock/out" ||
+			(strings.HasPrefix(path, "/a/users/") && (strings.HasSuffix(path, "/clock/in") || strings.HasSuffix(path, "/clock/out")))
+	}
+	return false
+}
+
+func keyTarget(id keyIDT) string {
+	return "key:" + strconv.Itoa(int(id))
+}
+
+// createAPIKey returns the key itself, which is only stored hashed and can't be shown again
+func createAPIKey(db execer, uid uidT, name string, scope apiKeyScope) (id keyIDT, key string, err error) {
+	if scope != scopeClock && scope != scopeRead && scope != scopeAdmin {
+		return 0, "", stacktrace.Propagate(errUnknownScope, "")
+	}
+
+	key = apiKeyPrefix + randomToken()
+	res, err := db.Exec(
+		`INSERT INTO api_keys (uid, name, key_hash, scope, created_unix_s)
+			VALUES (?1, ?2, ?3, ?4, ?5)`, uid, name, hashToken(key), scope, time.Now().Unix())
+	if err != nil {
+		return 0, "", stacktrace.Propagate(err, "failed to create API key")
+	}
+
+	lastID, err := res.LastInsertId()
+	return keyIDT(lastID), key, stacktrace.Propagate(err, "failed to get key id")
+}
+
+// getUserByAPIKey also records that the key was used
+func getUserByAPIKey(db *sql.DB, key string) (uid uidT, scope apiKeyScope, err error) {
+	hash := hashToken(key)
+	err = db.QueryRow("SELECT uid, scope FROM api_keys WHERE key_hash = ?", hash).Scan(&uid, &scope)
+	if err == sql.ErrNoRows {
+		return -1, "", stacktrace.Propagate(errInvalidToken, "")
+	}
+	if err != nil {
+		return -1, "", stacktrace.Propagate(err, "failed to get API key")
+	}
+
+	_, err = db.Exec("UPDATE api_keys SET last_used_unix_s = ?1 WHERE key_hash = ?2", time.Now().Unix(), hash)
+	return uid, scope, stacktrace.Propagate(err, "failed to update API key")
+}
+
+func listAPIKeys(db *sql.DB, uid uidT) (keys []apiKey, err error) {
+	rows, err := db.Query(
+		`SELECT key_id, name, scope, created_unix_s, COALESCE(last_used_unix_s, 0)
+			FROM api_keys WHERE uid = ? ORDER BY key_id`, uid)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list API keys")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var k apiKey
+		err = rows.Scan(&k.ID, &k.Name, &k.Scope, &k.CreatedAt, &k.LastUsed)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+// deleteAPIKey only deletes the key if it belongs to the given user
+func deleteAPIKey(db execer, uid uidT, id keyIDT) (found bool, err error) {
+	res, err := db.Exec("DELETE FROM api_keys WHERE key_id = ?1 AND uid = ?2", id, uid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to delete API key")
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, stacktrace.Propagate(err, "failed to get affected rows")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// audit actions, named after what they change
+const (
+	auditClockIn          = "clock.in"
+	auditAutoClockOut     = "clock.auto"
+	auditClockOut         = "clock.out"
+	auditEntryEdit        = "entry.edit"
+	auditEntryDelete      = "entry.delete"
+	auditDisqualify       = "entry.disqualify"
+	auditEntryImport      = "entry.import"
+	auditEntryCorrect     = "entry.correct"
+	auditEntryAdd         = "entry.add"
+	auditEntryReinstate   = "entry.reinstate"
+	auditUserCreate       = "user.create"
+	auditUserEmail        = "user.email"
+	auditUserActive       = "user.active"
+	auditUserPassword     = "user.password"
+	auditUserRoles        = "user.roles"
+	auditUserTOTP         = "user.totp"
+	auditUserTimeZone     = "user.timeZone"
+	auditUserBalance      = "user.balance"
+	auditScheduleSet      = "schedule.set"
+	auditScheduleDelete   = "schedule.delete"
+	auditLeaveDecide      = "leave.decide"
+	auditCorrectionDecide = "correction.decide"
+	auditTeamShifts       = "team.shifts"
+	auditTeamPolicy       = "team.policy"
+	auditTeamTimeZone     = "team.timeZone"
+	auditTeamOvertime     = "team.overtime"
+	auditOvertimeAdjust   = "overtime.adjust"
+	auditTeamMember       = "team.member"
+	auditHolidayAdd       = "holiday.add"
+	auditHolidayDelete    = "holiday.delete"
+	auditHolidayGenerate  = "holiday.generate"
+	auditHolidayImport    = "holiday.import"
+	auditLeaveTypeAdd     = "leaveType.add"
+	auditSessionRevoke    = "session.revoke"
+	auditKeyCreate        = "key.create"
+	auditKeyRevoke        = "key.revoke"
+	auditTeamCreate       = "team.create"
+	auditTeamUpdate       = "team.update"
+	auditTeamDelete       = "team.delete"
+)
+
+// systemActor is the actor of changes nobody asked for, e.g. closing forgotten shifts
+const systemActor uidT = 0
+
+func userTarget(uid uidT) string {
+	return "user:" + strconv.Itoa(int(uid))
+}
+
+func teamTarget(id teamIDT) string {
+	return "team:" + strconv.Itoa(int(id))
+}
+
+type auditRecord struct {
+	ID     int             `json:"id"`
+	At     int             `json:"at"`
+	Actor  uidT            `json:"actor"` // see systemActor
+	Action string          `json:"action"`
+	UID    uidT            `json:"uid"`    // whose data was changed
+	Target string          `json:"target"` // what was changed, e.g. entry:12
+	Before json.RawMessage `json:"before"` // null for anything that was created
+	After  json.RawMessage `json:"after"`  // null for anything that was deleted
+	Reason string          `json:"reason"`
+	Prev   string          `json:"prev"` // hash of the record before, see auditHash
+	Hash   string          `json:"hash"`
+}
+
+// recordAudit marshals before and after to JSON, nil is stored as null. It has to be called in the same
+// transaction as the change is made so that the record can't go missing, and so that it's chained to the
+// last one without another record getting in between, see the _txlock parameter in main
+func recordAudit(tx *sql.Tx, actor uidT, action string, uid uidT, target string, before, after interface{}, reason string) (err error) {
+	marshal := func(v interface{}) (json.RawMessage, error) {
+		if v == nil {
+			return nil, nil
+		}
+		return json.Marshal(v)
+	}
+
+	a := auditRecord{At: int(time.Now().Unix()), Actor: actor, Action: action, UID: uid, Target: target, Reason: reason}
+	a.Before, err = marshal(before)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to marshal old value")
+	}
+	a.After, err = marshal(after)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to marshal new value")
+	}
+
+	err = tx.QueryRow("SELECT COALESCE(MAX(audit_id), 0) + 1 FROM audit_log").Scan(&a.ID)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get next id")
+	}
+	err = tx.QueryRow("SELECT COALESCE((SELECT hash FROM audit_log ORDER BY audit_id DESC LIMIT 1), '')").Scan(&a.Prev)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get last hash")
+	}
+	a.Hash = auditHash(a)
+
+	_, err = tx.Exec(
+		`INSERT INTO audit_log (audit_id, at_unix_s, actor_uid, action, uid, target, before_json, after_json, reason, prev_hash, hash)
+			VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11)`,
+		a.ID, a.At, a.Actor, a.Action, a.UID, a.Target, nullableJSON(a.Before), nullableJSON(a.After), a.Reason, a.Prev, a.Hash)
+	return stacktrace.Propagate(err, "failed to record audit")
+}
+
+// execer is what *sql.DB and *sql.Tx have in common. Functions that make a single change take it so that
+// the change can be made in the transaction it's audited in, see env.audited
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// auditEntry is what a change says about itself in the audit log, the rest comes from the request
+type auditEntry struct {
+	action        string
+	uid           uidT
+	target        string
+	before, after interface{}
+}
+
+func nullableJSON(js json.RawMessage) interface{} {
+	if js == nil {
+		return nil
+	}
+	return string(js)
+}
+
+func scanAuditRecord(rows *sql.Rows) (a auditRecord, err error) {
+	var before, after sql.NullString
+	err = rows.Scan(&a.ID, &a.At, &a.Actor, &a.Action, &a.UID, &a.Target, &before, &after, &a.Reason, &a.Prev, &a.Hash)
+	if err != nil {
+		return a, stacktrace.Propagate(err, "failed to scan row")
+	}
+	if before.Valid {
+		a.Before = json.RawMessage(before.String)
+	}
+	if after.Valid {
+		a.After = json.RawMessage(after.String)
+	}
+	return a, nil
+}
+
+const auditColumns = "audit_id, at_unix_s, actor_uid, action, uid, target, before_json, after_json, reason, COALESCE(prev_hash, ''), COALESCE(hash, '')"
+
+type auditFilter struct {
+	UID       uidT // 0 for anyone
+	Actor     uidT // -1 for anyone, see systemActor
+	Action    string
+	From, To  int // unix time, To is exclusive
+	Before    int // only records with a smaller id, 0 for the newest ones
+	Limit     int
+	ManagedBy uidT // see managedBy
+}
+
+// listAudit lists the newest records first
+func listAudit(db *sql.DB, f auditFilter) (records []auditRecord, err error) {
+	rows, err := db.Query(
+		`SELECT `+auditColumns+` FROM audit_log
+			WHERE (?1 = 0 OR uid = ?1) AND (?2 = -1 OR actor_uid = ?2) AND (?3 = '' OR action = ?3)
+			AND at_unix_s >= ?4 AND at_unix_s < ?5 AND (?6 = 0 OR audit_id < ?6)
+			AND (?8 = 0 OR uid IN (SELECT uid FROM managed_users WHERE manager_uid = ?8))
+			ORDER BY audit_id DESC LIMIT ?7`, f.UID, f.Actor, f.Action, f.From, f.To, f.Before, f.Limit, f.ManagedBy)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list audit records")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		a, err := scanAuditRecord(rows)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "")
+		}
+		records = append(records, a)
+	}
+
+	return records, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// duration is written as a string like "1h30m" in the config file
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(raw []byte) (err error) {
+	var s string
+	err = json.Unmarshal(raw, &s)
+	if err != nil {
+		return err
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+type mailConfig struct {
+	From     string `json:"from"`
+	SMTPHost string `json:"smtpHost"` // mail is only printed to stdout if empty
+	SMTPPort int    `json:"smtpPort"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type loginConfig struct {
+	MaxAccountFailures int      `json:"maxAccountFailures"` // locks the account out after this many failures in a row
+	MaxIPFailures      int      `json:"maxIPFailures"`      // same for a client address
+	Lockout            duration `json:"lockout"`
+	Backoff            duration `json:"backoff"`   // the wait after the first failure, doubles with each one after it
+	Window             duration `json:"window"`    // failures older than this are forgotten
+	Retention          duration `json:"retention"` // how long attempts are kept for the security log
+}
+
+type config struct {
+	FrontendURL         string         `json:"frontendURL"` // used to build links sent in emails
+	Secret              string         `json:"secret"`      // signs links sent in emails, random on every start if empty
+	RequireVerification bool           `json:"requireVerification"`
+	TrustProxy          bool           `json:"trustProxy"` // take client addresses from X-Forwarded-For
+	SessionAbsolute     duration       `json:"sessionAbsoluteTimeout"`
+	SessionIdle         duration       `json:"sessionIdleTimeout"`
+	PasswordHash        hashParams     `json:"passwordHash"` // existing hashes are upgraded on login
+	Login               loginConfig    `json:"login"`
+	Mail                mailConfig     `json:"mail"`
+	SigningKey          string         `json:"signingKey"`     // base64 ed25519 seed for audit checkpoints, they're unsigned if empty
+	ClockOutPolicy      clockOutPolicy `json:"clockOutPolicy"` // for users whose teams don't have one
+	OvertimePolicy      overtimePolicy `json:"overtimePolicy"` // see above
+	TimeZone            string         `json:"timeZone"`       // like Europe/Vienna, for users whose teams don't have one, the server's if empty
+}
+
+var defaultConfig = config{
+	FrontendURL:         "http://localhost:8080",
+	RequireVerification: true,
+	SessionAbsolute:     duration{time.Hour * 24 * 31},
+	SessionIdle:         duration{time.Hour * 24 * 7},
+	PasswordHash: hashParams{
+		Time:       2,
+		Memory:     64 * 1024,
+		Threads:    1,
+		SaltLength: 16,
+		KeyLength:  32,
+	},
+	Login: loginConfig{
+		MaxAccountFailures: 10,
+		MaxIPFailures:      50,
+		Lockout:            duration{time.Minute * 15},
+		Backoff:            duration{time.Second},
+		Window:             duration{time.Hour},
+		Retention:          duration{time.Hour * 24 * 90},
+	},
+	Mail: mailConfig{
+		From:     "wms2@localhost",
+		SMTPPort: 25,
+	},
+	ClockOutPolicy: clockOutPolicy{Kind: policyDisqualify},
+}
+
+// loadConfig reads the config file, settings missing from it keep their default values
+func loadConfig(path string) (c config, err error) {
+	c = defaultConfig
+
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, stacktrace.Propagate(err, "failed to read config file")
+	}
+
+	err = json.Unmarshal(raw, &c)
+	return c, stacktrace.Propagate(err, "failed to parse config file")
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+type cidT int
+
+// kinds of corrections, see the corrections table
+const (
+	correctionAdd        = "A"
+	correctionEdit       = "E"
+	correctionRevalidate = "V"
+)
+
+// correction is an employee's request to change their own entries, which is only applied once it's approved
+type correction struct {
+	CID         cidT   `json:"cid"`
+	UID         uidT   `json:"uid"`
+	Kind        string `json:"kind"`
+	EID         eidT   `json:"eid"`   // 0 for additions that weren't approved yet
+	From        int    `json:"from"`  // 0 for revalidations
+	To          int    `json:"to"`    // the end the entry gets, also when revalidating
+	Entry       *entry `json:"entry"` // as it was when the correction was requested, nil for additions
+	Reason      string `json:"reason"`
+	Status      string `json:"status"`
+	RequestedAt int    `json:"requestedAt"`
+	DecidedBy   uidT   `json:"decidedBy"` // 0 if undecided
+	DecidedAt   int    `json:"decidedAt"` // see above
+}
+
+var (
+	errCorrectionNotPending = errors.New("correction is not pending")
+	errCorrectionPending    = errors.New("there already is a pending correction of the entry")
+	errCorrectionEntry      = errors.New("the entry can't be corrected that way")
+	errOwnCorrection        = errors.New("corrections can't be decided by whoever requested them")
+)
+
+func correctionTarget(cid cidT) string {
+	return "correction:" + strconv.Itoa(int(cid))
+}
+
+// requestCorrection checks the entry against the kind of correction, it has to belong
+// to the user, and only disqualified entries can be revalidated, with an end after their start
+func requestCorrection(db *sql.DB, c correction) (cid cidT, err error) {
+	tx, err := db.Begin()
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+	if err != nil {
+		return -1, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+
+	var eid, from, to interface{} // stored as null where they don't apply
+	var e entry
+	switch c.Kind {
+	case correctionAdd:
+		from, to = c.From, c.To
+	case correctionEdit, correctionRevalidate:
+		var uid uidT
+		uid, e, err = getEntry(tx, c.EID)
+		if stacktrace.RootCause(err) == sql.ErrNoRows || (err == nil && uid != c.UID) {
+			rollback()
+			return -1, stacktrace.Propagate(errCorrectionEntry, "no such entry")
+		}
+		if err != nil {
+			rollback()
+			return -1, stacktrace.Propagate(err, "")
+		}
+		if c.Kind == correctionRevalidate && e.Valid {
+			rollback()
+			return -1, stacktrace.Propagate(errCorrectionEntry, "the entry is valid")
+		}
+		if c.Kind == correctionRevalidate && c.To < e.From {
+			rollback()
+			return -1, stacktrace.Propagate(errCorrectionEntry, "the entry would end before it starts")
+		}
+
+		err = tx.QueryRow("SELECT 1 FROM corrections WHERE eid = ? AND status = 'P'", c.EID).Scan(new(int))
+		if err == nil {
+			rollback()
+			return -1, stacktrace.Propagate(errCorrectionPending, "")
+		}
+		if err != sql.ErrNoRows {
+			rollback()
+			return -1, stacktrace.Propagate(err, "failed to check for pending corrections")
+		}
+
+		eid = c.EID
+		if c.Kind == correctionEdit {
+			from = c.From
+		}
+		to = c.To
+	default:
+		rollback()
+		return -1, stacktrace.NewError("unknown kind of correction %q", c.Kind)
+	}
+
+	// checked again when it's approved, since the entries may have changed by then
+	checkFrom := c.From
+	if c.Kind == correctionRevalidate {
+		checkFrom = e.From
+	}
+	err = checkOverlap(tx, c.UID, checkFrom, c.To, c.EID)
+	if err != nil {
+		rollback()
+		return -1, stacktrace.Propagate(err, "")
+	}
+
+	var entryFrom, entryTo, entryValid interface{} // see above
+	if c.Kind != correctionAdd {
+		entryFrom, entryTo, entryValid = e.From, e.To, e.Valid
+	}
+
+	res, err := tx.Exec(
+		`INSERT INTO corrections (uid, kind, eid, from_unix_s, to_unix_s, entry_from_unix_s, entry_to_unix_s, entry_valid,
+			reason, status, requested_unix_s) VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, 'P', ?10)`,
+		c.UID, c.Kind, eid, from, to, entryFrom, entryTo, entryValid, c.Reason, time.Now().Unix())
+	if err != nil {
+		rollback()
+		return -1, stacktrace.Propagate(err, "failed to insert a row into the corrections table")
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		rollback()
+		return -1, stacktrace.Propagate(err, "failed to get cid")
+	}
+
+	return cidT(id), stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+const correctionColumns = `cid, uid, kind, COALESCE(eid, 0), COALESCE(from_unix_s, 0), COALESCE(to_unix_s, 0),
+	entry_from_unix_s, entry_to_unix_s, entry_valid, reason, status, requested_unix_s, COALESCE(decided_by, 0),
+	COALESCE(decided_unix_s, 0)`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanCorrection(row scanner) (c correction, err error) {
+	var entryFrom, entryTo sql.NullInt64
+	var entryValid sql.NullBool
+	err = row.Scan(&c.CID, &c.UID, &c.Kind, &c.EID, &c.From, &c.To, &entryFrom, &entryTo, &entryValid, &c.Reason,
+		&c.Status, &c.RequestedAt, &c.DecidedBy, &c.DecidedAt)
+	if entryFrom.Valid { // null for additions, and for corrections decided before entries were stored with them
+		c.Entry = &entry{EID: c.EID, From: int(entryFrom.Int64), To: int(entryTo.Int64), Valid: entryValid.Bool}
+	}
+	return c, err
+}
+
+// listCorrections works like listLeave
+func listCorrections(db *sql.DB, uid uidT, status string, managedBy uidT) (corrections []correction, err error) {
+	rows, err := db.Query(
+		`SELECT `+correctionColumns+` FROM corrections
+			WHERE (?1 = 0 OR uid = ?1) AND (?2 = '' OR status = ?2)
+			AND (?3 = 0 OR uid IN (SELECT uid FROM managed_users WHERE manager_uid = ?3))
+			ORDER BY requested_unix_s`, uid, status, managedBy)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list corrections")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c, err := scanCorrection(rows)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		corrections = append(corrections, c)
+	}
+
+	return corrections, nil
+}
+
+func getCorrection(tx *sql.Tx, cid cidT) (c correction, err error) {
+	c, err = scanCorrection(tx.QueryRow(`SELECT `+correctionColumns+` FROM corrections WHERE cid = ?`, cid))
+	return c, stacktrace.Propagate(err, "failed to get correction")
+}
+
+// countCorrectionsToDecide counts the pending corrections of everyone, or of the members of the manager's teams
+func countCorrectionsToDecide(db *sql.DB, decider uidT, managedBy uidT) (count int, err error) {
+	err = db.QueryRow(
+		`SELECT COUNT(*) FROM corrections WHERE status = 'P' AND uid != ?1
+			AND (?2 = 0 OR uid IN (SELECT uid FROM managed_users WHERE manager_uid = ?2))`, decider, managedBy).Scan(&count)
+	return count, stacktrace.Propagate(err, "failed to count corrections")
+}
+
+// decideCorrection applies approved corrections to the entries right away, both the decision and the
+// change of the entry are recorded, the latter with the correction and its reason as the reason
+func decideCorrection(db *sql.DB, cid cidT, decider uidT, approve bool, note string) (err error) {
+	tx, err := db.Begin()
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to begin transaction")
+	}
+
+	c, err := getCorrection(tx, cid)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "")
+	}
+	if c.Status != "P" {
+		rollback()
+		return stacktrace.Propagate(errCorrectionNotPending, "")
+	}
+	if c.UID == decider {
+		rollback()
+		return stacktrace.Propagate(errOwnCorrection, "")
+	}
+
+	status := "R"
+	if approve {
+		status = "A"
+		c.EID, err = applyCorrection(tx, c, decider)
+		if err != nil {
+			rollback()
+			return stacktrace.Propagate(err, "")
+		}
+	}
+
+	_, err = tx.Exec(
+		`UPDATE corrections SET status = ?1, eid = NULLIF(?2, 0), decided_by = ?3, decided_unix_s = ?4
+			WHERE cid = ?5`, status, c.EID, decider, time.Now().Unix(), cid)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "failed to update correction")
+	}
+
+	err = recordAudit(tx, decider, auditCorrectionDecide, c.UID, correctionTarget(cid),
+		map[string]interface{}{"status": c.Status}, map[string]interface{}{"status": status, "eid": c.EID}, note)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "")
+	}
+
+	return stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// applyCorrection returns the entry that was changed or added, the entry has to be as it was
+// when the correction was requested, otherwise errCorrectionEntry is returned
+func applyCorrection(tx *sql.Tx, c correction, actor uidT) (eid eidT, err error) {
+	reason := correctionTarget(c.CID) + ": " + c.Reason
+
+	if c.Kind == correctionAdd {
+		err = checkOverlap(tx, c.UID, c.From, c.To, 0)
+		if err != nil {
+			return 0, stacktrace.Propagate(err, "")
+		}
+
+		res, err := tx.Exec(
+			"INSERT INTO entries (uid, from_unix_s, to_unix_s, valid) VALUES (?1, ?2, ?3, 1)", c.UID, c.From, c.To)
+		if err != nil {
+			return 0, stacktrace.Propagate(err, "failed to add entry")
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return 0, stacktrace.Propagate(err, "failed to get entry id")
+		}
+
+		eid = eidT(id)
+		err = recordAudit(tx, actor, auditEntryCorrect, c.UID, entryTarget(eid), nil, entry{EID: eid, From: c.From, To: c.To, Valid: true}, reason)
+		return eid, stacktrace.Propagate(err, "")
+	}
+
+	uid, before, err := getEntry(tx, c.EID)
+	if stacktrace.RootCause(err) == sql.ErrNoRows || (err == nil && uid != c.UID) {
+		return 0, stacktrace.Propagate(errCorrectionEntry, "the entry was deleted")
+	}
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	if c.Entry == nil || before.From != c.Entry.From || before.To != c.Entry.To || before.Valid != c.Entry.Valid {
+		return 0, stacktrace.Propagate(errCorrectionEntry, "the entry was changed")
+	}
+
+	after := before
+	if c.Kind == correctionEdit {
+		after.From, after.To = c.From, c.To
+	} else {
+		after.To, after.Valid = c.To, true
+	}
+	err = checkOverlap(tx, c.UID, after.From, after.To, c.EID)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	_, err = tx.Exec("UPDATE entries SET from_unix_s = ?1, to_unix_s = ?2, valid = ?3 WHERE eid = ?4",
+		after.From, after.To, after.Valid, c.EID)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to correct entry")
+	}
+
+	err = recordAudit(tx, actor, auditEntryCorrect, c.UID, entryTarget(c.EID), before, after, reason)
+	return c.EID, stacktrace.Propagate(err, "")
+}
+
+func cancelCorrection(db *sql.DB, uid uidT, cid cidT) (err error) {
+	res, err := db.Exec("UPDATE corrections SET status = 'C' WHERE cid = ?1 AND uid = ?2 AND status = 'P'", cid, uid)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to cancel correction")
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get affected rows")
+	}
+	if affected == 0 {
+		return stacktrace.Propagate(errCorrectionNotPending, "")
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"strconv"
 	"time"
@@ -11,52 +12,101 @@ import (
 
 type eidT int
 
+var (
+	errEntryOverlap = errors.New("entry overlaps another entry or the open shift")
+	errEntryValid   = errors.New("entry is valid")
+	errEntryEnd     = errors.New("entry would end before it starts")
+)
+
 type entry struct {
-	EID   eidT `json:"eid"`
-	From  int  `json:"from"`
-	To    int  `json:"to"`
-	Valid bool `json:"valid"`
+	EID          eidT   `json:"eid"`
+	From         int    `json:"from"`
+	To           int    `json:"to"`
+	Valid        bool   `json:"valid"`
+	Policy       string `json:"policy,omitempty"`       // the clock-out policy that closed the shift, see closeForgottenShifts
+	PolicyReason string `json:"policyReason,omitempty"` // see above
 }
 
-func disqualify(db *sql.DB) {
-	rows, err := db.Query("SELECT uid, since_unix_s FROM user_states WHERE state = 'I'")
-	if err != nil {
-		fmt.Println(stacktrace.Propagate(err, "failed to select users to disqualify"))
-		return
-	}
+// entryColumns are scanned by scanEntry
+const entryColumns = "eid, from_unix_s, to_unix_s, valid, COALESCE(auto_policy, ''), COALESCE(auto_reason, '')"
 
-	type userSince struct {
-		uid   int
-		since int
-	}
-	toDisq := []userSince{}
+func scanEntry(row scanner) (e entry, err error) {
+	err = row.Scan(&e.EID, &e.From, &e.To, &e.Valid, &e.Policy, &e.PolicyReason)
+	return e, err
+}
 
-	for rows.Next() {
-		var us userSince
-		err = rows.Scan(&us.uid, &us.since)
+// userState is what's recorded in the audit log for clock-ins and outs
+type userState struct {
+	State string `json:"state"`
+	Since int    `json:"since"`
+}
+
+func entryTarget(eid eidT) string {
+	return "entry:" + strconv.Itoa(int(eid))
+}
+
+// closeShift clocks out a user who forgot to, see closeForgottenShifts. The shift is only closed
+// if it's still the one that started at since, in case the user clocked out in the meantime
+func closeShift(db *sql.DB, uid uidT, since, to int, valid bool, policy, reason string) (err error) {
+	tx, err := db.Begin()
+	rollback := func() {
+		err := tx.Rollback()
 		if err != nil {
-			fmt.Print(stacktrace.Propagate(err, "failed to scan row"))
+			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
 		}
-		toDisq = append(toDisq, us)
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to begin transaction")
 	}
 
-	for _, x := range toDisq {
-		_, err = db.Exec("INSERT INTO entries (uid, from_unix_s, to_unix_s, valid) VALUES (?1, ?2, ?3, 0)", x.uid, x.since, time.Now().Unix())
-		if err != nil {
-			fmt.Println(stacktrace.Propagate(err, "failed to add disqualifying entry for "+strconv.Itoa(x.uid)))
-		}
+	res, err := tx.Exec("UPDATE user_states SET state = 'O', since_unix_s = ?1 WHERE uid = ?2 AND state = 'I' AND since_unix_s = ?3",
+		to, uid, since)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "failed to clock out user")
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "failed to get affected rows")
+	}
+	if affected == 0 {
+		rollback()
+		return nil // already clocked out
 	}
 
-	_, err = db.Exec("UPDATE user_states SET state = 'O', since_unix_s = ? WHERE state = 'I'", time.Now().Unix())
+	res, err = tx.Exec(
+		`INSERT INTO entries (uid, from_unix_s, to_unix_s, valid, auto_policy, auto_reason)
+			VALUES (?1, ?2, ?3, ?4, ?5, ?6)`, uid, since, to, valid, policy, reason)
 	if err != nil {
-		fmt.Println(stacktrace.Propagate(err, "failed to clock out disqualified users"))
+		rollback()
+		return stacktrace.Propagate(err, "failed to add entry")
 	}
+	eid, err := res.LastInsertId()
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "failed to get entry id")
+	}
+
+	action := auditAutoClockOut
+	if !valid {
+		action = auditDisqualify
+	}
+	e := entry{EID: eidT(eid), From: since, To: to, Valid: valid, Policy: policy, PolicyReason: reason}
+	err = recordAudit(tx, systemActor, action, uid, entryTarget(e.EID), nil, e, reason)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "")
+	}
+
+	return stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
 }
 
-func clockIn(db *sql.DB, uid uidT) (err error) {
+// clockIn and clockOut are made by the actor on behalf of the user, who's usually the same person
+func clockIn(db *sql.DB, uid, actor uidT) (err error) {
 	tx, err := db.Begin()
 	rollback := func() {
-		err = tx.Rollback()
+		err := tx.Rollback()
 		if err != nil {
 			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
 		}
@@ -65,31 +115,38 @@ func clockIn(db *sql.DB, uid uidT) (err error) {
 		return stacktrace.Propagate(err, "failed to begin transaction")
 	}
 
-	var state string
-	err = db.QueryRow("SELECT state FROM user_states WHERE uid = ?", uid).Scan(&state)
+	var before userState
+	err = tx.QueryRow("SELECT state, since_unix_s FROM user_states WHERE uid = ?", uid).Scan(&before.State, &before.Since)
 	if err != nil {
 		rollback()
 		return stacktrace.Propagate(err, "failed to find a row in user_states for specified user")
 	}
 
-	if state == "I" {
+	if before.State == "I" {
 		rollback()
 		return nil // already clocked in
 	}
 
-	_, err = db.Exec("UPDATE user_states SET state = 'I', since_unix_s = ?1 WHERE uid = ?2", time.Now().Unix(), uid)
+	after := userState{"I", int(time.Now().Unix())}
+	_, err = tx.Exec("UPDATE user_states SET state = ?1, since_unix_s = ?2 WHERE uid = ?3", after.State, after.Since, uid)
 	if err != nil {
 		rollback()
 		return stacktrace.Propagate(err, "failed to update user state")
 	}
 
+	err = recordAudit(tx, actor, auditClockIn, uid, userTarget(uid), before, after, "")
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "")
+	}
+
 	return stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
 }
 
-func clockOut(db *sql.DB, uid uidT) (err error) {
+func clockOut(db *sql.DB, uid, actor uidT) (err error) {
 	tx, err := db.Begin()
 	rollback := func() {
-		err = tx.Rollback()
+		err := tx.Rollback()
 		if err != nil {
 			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
 		}
@@ -100,7 +157,7 @@ func clockOut(db *sql.DB, uid uidT) (err error) {
 
 	var state string
 	var since int
-	err = db.QueryRow("SELECT state, since_unix_s FROM user_states WHERE uid = ?", uid).Scan(&state, &since)
+	err = tx.QueryRow("SELECT state, since_unix_s FROM user_states WHERE uid = ?", uid).Scan(&state, &since)
 	if err != nil {
 		rollback()
 		return stacktrace.Propagate(err, "failed to find a row in user_states for specified user")
@@ -111,130 +168,460 @@ func clockOut(db *sql.DB, uid uidT) (err error) {
 		return nil // already clocked out
 	}
 
-	now := time.Now().Unix() // so that it doesn't change between the next two SQL statements
-	_, err = db.Exec("INSERT INTO entries (uid, from_unix_s, to_unix_s, valid) VALUES (?1, ?2, ?3, 1)", uid, since, now)
+	now := int(time.Now().Unix()) // so that it doesn't change between the next two SQL statements
+	res, err := tx.Exec("INSERT INTO entries (uid, from_unix_s, to_unix_s, valid) VALUES (?1, ?2, ?3, 1)", uid, since, now)
 	if err != nil {
 		rollback()
 		return stacktrace.Propagate(err, "failed to insert an entry")
 	}
-	_, err = db.Exec("UPDATE user_states SET state = 'O', since_unix_s = ?1 WHERE uid = ?2", now, uid)
+	eid, err := res.LastInsertId()
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "failed to get entry id")
+	}
+	_, err = tx.Exec("UPDATE user_states SET state = 'O', since_unix_s = ?1 WHERE uid = ?2", now, uid)
 	if err != nil {
 		rollback()
 		return stacktrace.Propagate(err, "failed to update user state")
 	}
 
+	err = recordAudit(tx, actor, auditClockOut, uid, entryTarget(eidT(eid)), nil, entry{EID: eidT(eid), From: since, To: now, Valid: true}, "")
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "")
+	}
+
+	return stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// checkOverlap returns errEntryOverlap if the time from to to overlaps any of the user's entries other than except,
+// valid or not, or the shift they're clocked in for. Entries that only touch at one end don't overlap
+func checkOverlap(tx *sql.Tx, uid uidT, from, to int, except eidT) (err error) {
+	err = tx.QueryRow(
+		`SELECT 1 FROM entries WHERE uid = ?1 AND eid != ?2 AND from_unix_s < ?4 AND to_unix_s > ?3
+			UNION ALL SELECT 1 FROM user_states WHERE uid = ?1 AND state = 'I' AND since_unix_s < ?4`,
+		uid, except, from, to).Scan(new(int))
+	if err == nil {
+		return stacktrace.Propagate(errEntryOverlap, "")
+	}
+	if err != sql.ErrNoRows {
+		return stacktrace.Propagate(err, "failed to check for overlapping entries")
+	}
+	return nil
+}
+
+// addEntry is for entries the user didn't clock, e.g. because they were on a business trip
+func addEntry(db *sql.DB, uid uidT, from, to int, valid bool, actor uidT, reason string) (eid eidT, err error) {
+	tx, err := db.Begin()
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+	if err != nil {
+		return -1, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+
+	err = checkOverlap(tx, uid, from, to, 0)
+	if err != nil {
+		rollback()
+		return -1, stacktrace.Propagate(err, "")
+	}
+
+	res, err := tx.Exec("INSERT INTO entries (uid, from_unix_s, to_unix_s, valid) VALUES (?1, ?2, ?3, ?4)", uid, from, to, valid)
+	if err != nil {
+		rollback()
+		return -1, stacktrace.Propagate(err, "failed to insert an entry")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		rollback()
+		return -1, stacktrace.Propagate(err, "failed to get entry id")
+	}
+
+	eid = eidT(id)
+	err = recordAudit(tx, actor, auditEntryAdd, uid, entryTarget(eid), nil, entry{EID: eid, From: from, To: to, Valid: valid}, reason)
+	if err != nil {
+		rollback()
+		return -1, stacktrace.Propagate(err, "")
+	}
+
+	return eid, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// reinstateEntry undoes a disqualification, the entry ends at the given time instead of midnight
+func reinstateEntry(db *sql.DB, eid eidT, to int, actor uidT, reason string) (err error) {
+	tx, err := db.Begin()
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to begin transaction")
+	}
+
+	uid, before, err := getEntry(tx, eid)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "")
+	}
+	if before.Valid {
+		rollback()
+		return stacktrace.Propagate(errEntryValid, "")
+	}
+	if to < before.From {
+		rollback()
+		return stacktrace.Propagate(errEntryEnd, "")
+	}
+
+	err = checkOverlap(tx, uid, before.From, to, eid)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "")
+	}
+
+	_, err = tx.Exec("UPDATE entries SET to_unix_s = ?1, valid = 1 WHERE eid = ?2", to, eid)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "failed to reinstate entry")
+	}
+
+	after := before
+	after.To, after.Valid = to, true
+	err = recordAudit(tx, actor, auditEntryReinstate, uid, entryTarget(eid), before, after, reason)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "")
+	}
+
+	return stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+func getEntry(tx *sql.Tx, eid eidT) (uid uidT, e entry, err error) {
+	err = tx.QueryRow("SELECT uid, "+entryColumns+" FROM entries WHERE eid = ?", eid).
+		Scan(&uid, &e.EID, &e.From, &e.To, &e.Valid, &e.Policy, &e.PolicyReason)
+	return uid, e, stacktrace.Propagate(err, "failed to get entry")
+}
+
+// editEntry returns sql.ErrNoRows as the root cause if there's no such entry
+func editEntry(db *sql.DB, eid eidT, from, to int, actor uidT, reason string) (err error) {
+	tx, err := db.Begin()
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to begin transaction")
+	}
+
+	uid, before, err := getEntry(tx, eid)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "")
+	}
+
+	err = checkOverlap(tx, uid, from, to, eid)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "")
+	}
+
+	_, err = tx.Exec("UPDATE entries SET from_unix_s = ?1, to_unix_s = ?2 WHERE eid = ?3", from, to, eid)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "failed to edit entry")
+	}
+
+	after := before
+	after.From, after.To = from, to
+	err = recordAudit(tx, actor, auditEntryEdit, uid, entryTarget(eid), before, after, reason)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "")
+	}
+
 	return stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
 }
 
-func editEntry(db *sql.DB, eid eidT, from, to int) (err error) {
-	_, err = db.Exec("UPDATE entries SET from_unix_s = ?1, to_unix_s = ?2 WHERE eid = ?3", from, to, eid)
-	return stacktrace.Propagate(err, "failed to edit entry")
+// deleteEntry returns sql.ErrNoRows as the root cause if there's no such entry
+func deleteEntry(db *sql.DB, eid eidT, actor uidT, reason string) (err error) {
+	tx, err := db.Begin()
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to begin transaction")
+	}
+
+	uid, before, err := getEntry(tx, eid)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "")
+	}
+
+	_, err = tx.Exec("DELETE FROM entries WHERE eid = ?", eid)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "failed to delete entry")
+	}
+
+	err = recordAudit(tx, actor, auditEntryDelete, uid, entryTarget(eid), before, nil, reason)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "")
+	}
+
+	return stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// dayEntry is an entry as it's listed under one of the days it spans
+type dayEntry struct {
+	entry
+	Seconds int `json:"seconds"` // the part of the entry that counts towards the day
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// splitByDay returns how many of the seconds from from to to fall on each day in loc, keyed by the start of the day.
+// Shifts that cross midnight are split at it, unless wholeShifts is set, then they count towards the day they start on
+func splitByDay(from, to int, loc *time.Location, wholeShifts bool) (days map[int64]int) {
+	days = make(map[int64]int)
+	start := time.Unix(int64(from), 0).In(loc)
+	if wholeShifts || to <= from {
+		days[startOfDay(start).Unix()] = to - from
+		return days
+	}
+
+	for day := startOfDay(start); day.Unix() < int64(to); day = nextMidnight(day) {
+		dayFrom, dayTo := int(day.Unix()), int(nextMidnight(day).Unix())
+		if dayFrom < from {
+			dayFrom = from
+		}
+		if dayTo > to {
+			dayTo = to
+		}
+		days[day.Unix()] = dayTo - dayFrom
+	}
+	return days
+}
+
+// countsWholeShifts tells whether the user's shifts count towards the day they start on, see splitByDay
+func countsWholeShifts(db *sql.DB, uid uidT) (whole bool, err error) {
+	value, err := getUserTeamSetting(db, uid, "whole_shifts")
+	return value.Valid && value.String == "1", stacktrace.Propagate(err, "")
 }
 
-func deleteEntry(db *sql.DB, eid eidT) (err error) {
-	_, err = db.Exec("DELETE FROM entries WHERE eid = ?", eid)
-	return stacktrace.Propagate(err, "failed to delete entry")
+type entryFilter struct {
+	UID      uidT
+	From, To int  // unix time, entries that overlap the range, To is exclusive, 0 for no bound
+	Valid    int  // 1 for only valid entries, 0 for only disqualified ones, -1 for both
+	After    eidT // only entries that come after this one in the order, 0 to start at the beginning
+	Desc     bool // newest first
+	Limit    int  // 0 for no limit
 }
 
-func listEntries(db *sql.DB, uid uidT) (days map[int64][]entry, err error) {
-	rows, err := db.Query("SELECT eid, from_unix_s, to_unix_s, valid FROM entries WHERE uid = ?", uid)
+// listEntries lists the user's entries by when they start
+func listEntries(db *sql.DB, f entryFilter) (entries []entry, err error) {
+	cmp, order := ">", "ASC"
+	if f.Desc {
+		cmp, order = "<", "DESC"
+	}
+	limit := f.Limit
+	if limit == 0 {
+		limit = -1 // no limit to SQLite
+	}
+
+	rows, err := db.Query(
+		`SELECT `+entryColumns+` FROM entries
+			WHERE uid = ?1 AND (?2 = 0 OR to_unix_s > ?2) AND (?3 = 0 OR from_unix_s < ?3) AND (?4 = -1 OR valid = ?4)
+			AND (?5 = 0 OR (from_unix_s, eid) `+cmp+` (SELECT from_unix_s, eid FROM entries WHERE eid = ?5 AND uid = ?1))
+			ORDER BY from_unix_s `+order+`, eid `+order+` LIMIT ?6`, f.UID, f.From, f.To, f.Valid, f.After, limit)
 	if err != nil {
 		return nil, stacktrace.Propagate(err, "failed to list entries")
 	}
+	defer rows.Close()
 
-	ens := []entry{}
-	en := entry{}
 	for rows.Next() {
-		err = rows.Scan(&en.EID, &en.From, &en.To, &en.Valid)
+		en, err := scanEntry(rows)
 		if err != nil {
 			return nil, stacktrace.Propagate(err, "failed to scan row")
 		}
-		ens = append(ens, en)
+		entries = append(entries, en)
 	}
 
-	days = make(map[int64][]entry)
-	for _, x := range ens {
-		date := time.Unix(int64(x.From), 0)
-		key := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location()).Unix()
-		days[key] = append(days[key], x)
+	return entries, nil
+}
+
+// groupEntriesByDay lists the entries under each of the days in loc they span,
+// leaving out days before from and from to on, unless it's 0
+func groupEntriesByDay(db *sql.DB, uid uidT, entries []entry, loc *time.Location, from, to int) (days map[int64][]dayEntry, err error) {
+	wholeShifts, err := countsWholeShifts(db, uid)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
+
+	days = make(map[int64][]dayEntry)
+	for _, en := range entries {
+		for key, seconds := range splitByDay(en.From, en.To, loc, wholeShifts) {
+			if key < int64(from) || (to != 0 && key >= int64(to)) {
+				continue
+			}
+			days[key] = append(days[key], dayEntry{en, seconds})
+		}
 	}
 
 	return days, nil
 }
 
-func getDeltaForDay(db *sql.DB, uid uidT, date time.Time) (delta int, err error) {
-	// TODO: account for holidays
+// getWorked returns how many seconds of the user's valid entries and of the shift they're
+// clocked in for fall between start and end, with shifts split like splitByDay does in the location of start
+func getWorked(db *sql.DB, uid uidT, start, end time.Time) (worked int, err error) {
+	days, err := getWorkedByDay(db, uid, start, end)
+	for _, seconds := range days {
+		worked += seconds
+	}
+	return worked, stacktrace.Propagate(err, "")
+}
+
+// getWorkedByDay is getWorked for each day, keyed like splitByDay
+func getWorkedByDay(db *sql.DB, uid uidT, start, end time.Time) (days map[int64]int, err error) {
+	wholeShifts, err := countsWholeShifts(db, uid)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "")
+	}
 
-	sod := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
-	eod := time.Date(date.Year(), date.Month(), date.Day()+1, 0, 0, 0, 0, date.Location())
 	rows, err := db.Query(
-		`SELECT from_unix_s, to_unix_s FROM entries
-			WHERE uid = ?1 AND valid = 1
-			AND from_unix_s > ?2 AND to_unix_s < ?3`, uid, sod.Unix(), eod.Unix())
+		`SELECT from_unix_s, to_unix_s FROM entries WHERE uid = ?1 AND valid = 1 AND from_unix_s < ?3 AND to_unix_s > ?2
+			UNION ALL SELECT since_unix_s, ?4 FROM user_states WHERE uid = ?1 AND state = 'I' AND since_unix_s < ?3`,
+		uid, start.Unix(), end.Unix(), time.Now().Unix())
 	if err != nil {
-		return delta, stacktrace.Propagate(err, "failed to get entries in date range")
+		return nil, stacktrace.Propagate(err, "failed to get entries in date range")
 	}
+	defer rows.Close()
 
+	days = make(map[int64]int)
 	for rows.Next() {
 		var from, to int
-		rows.Scan(&from, &to)
-		delta += to - from
+		err = rows.Scan(&from, &to)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		for key, seconds := range splitByDay(from, to, start.Location(), wholeShifts) {
+			if key >= startOfDay(start).Unix() && key < end.Unix() {
+				days[key] += seconds
+			}
+		}
 	}
 
-	if date.Weekday() != time.Saturday && date.Weekday() != time.Sunday {
-		delta -= 8 * 60 * 60
-	}
+	return days, nil
+}
 
-	var state string
-	var since int
-	err = db.QueryRow("SELECT state, since_unix_s FROM user_states WHERE uid = ?", uid).Scan(&state, &since)
+// expectedTime has everything that decides how long a user is expected to work on a range of days,
+// loaded at once so that walking the days doesn't take queries for each of them
+type expectedTime struct {
+	schedules []schedule         // oldest first
+	holidays  map[string]holiday // by date
+	leave     []leaveRequest     // approved only
+}
+
+// loadExpectedTime loads what's needed for the dates from and to, both inclusive
+func loadExpectedTime(db *sql.DB, uid uidT, from, to time.Time) (e expectedTime, err error) {
+	e.schedules, err = listSchedules(db, uid)
 	if err != nil {
-		return delta, stacktrace.Propagate(err, "failed to get user info")
+		return e, stacktrace.Propagate(err, "failed to get schedules")
 	}
 
-	if state == "I" {
-		delta += int(time.Now().Unix()) - since
+	holidays, err := listHolidays(db, from.Format(dateLayout), to.Format(dateLayout))
+	if err != nil {
+		return e, stacktrace.Propagate(err, "failed to get holidays")
+	}
+	e.holidays = make(map[string]holiday)
+	for _, h := range holidays {
+		e.holidays[h.Date] = h
 	}
 
-	return delta, nil
+	e.leave, err = listApprovedLeave(db, uid, from.Format(dateLayout), to.Format(dateLayout))
+	return e, stacktrace.Propagate(err, "failed to get leave")
 }
 
-func getDeltaForMonth(db *sql.DB, uid uidT, date time.Time) (delta int, err error) {
-	// TODO: account for holidays
+// forDay returns how many seconds the user is expected to work on the given date, which has to be within
+// the dates the expected time was loaded for
+func (e expectedTime) forDay(date time.Time) (expected int) {
+	day := date.Format(dateLayout)
 
-	som := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, date.Location())
-	eod := time.Date(date.Year(), date.Month(), date.Day()+1, 0, 0, 0, 0, date.Location())
-	rows, err := db.Query(
-		`SELECT from_unix_s, to_unix_s FROM entries
-			WHERE uid = ?1 AND valid = 1
-			AND from_unix_s > ?2 AND to_unix_s < ?3`, uid, som.Unix(), eod.Unix())
-	if err != nil {
-		return delta, stacktrace.Propagate(err, "failed to get entries in date range")
+	s := defaultSchedule
+	for _, x := range e.schedules {
+		if x.EffectiveFrom <= day {
+			s = x
+		}
 	}
+	expected = s.Expected[date.Weekday()]
 
-	for rows.Next() {
-		var from, to int
-		rows.Scan(&from, &to)
-		delta += to - from
+	if h, ok := e.holidays[day]; ok && h.Half {
+		expected /= 2
+	} else if ok {
+		expected = 0
 	}
 
-	x := som
-	for x.Before(eod) {
-		if x.Weekday() != time.Saturday && x.Weekday() != time.Sunday {
-			delta -= 8 * 60 * 60
+	for _, l := range e.leave {
+		if l.From <= day && l.To >= day {
+			if l.Half {
+				return expected / 2
+			}
+			return 0
 		}
-		x = x.Add(time.Hour * 24)
 	}
+	return expected
+}
 
-	var state string
-	var since int
-	err = db.QueryRow("SELECT state, since_unix_s FROM user_states WHERE uid = ?", uid).Scan(&state, &since)
+// getExpectedForDay returns how many seconds the user is expected to work on the given date
+func getExpectedForDay(db *sql.DB, uid uidT, date time.Time) (expected int, err error) {
+	e, err := loadExpectedTime(db, uid, date, date)
 	if err != nil {
-		return delta, stacktrace.Propagate(err, "failed to get user info")
+		return expected, stacktrace.Propagate(err, "")
 	}
+	return e.forDay(date), nil
+}
 
-	if state == "I" {
-		delta += int(time.Now().Unix()) - since
+// getDeltaForDay and getDeltaForMonth take date in the user's location, see getUserLocation
+func getDeltaForDay(db *sql.DB, uid uidT, date time.Time) (delta int, err error) {
+	sod := startOfDay(date)
+	delta, err = getWorked(db, uid, sod, nextMidnight(sod))
+	if err != nil {
+		return delta, stacktrace.Propagate(err, "")
+	}
+
+	expected, err := getExpectedForDay(db, uid, date)
+	if err != nil {
+		return delta, stacktrace.Propagate(err, "failed to get expected time")
+	}
+	return delta - expected, nil
+}
+
+func getDeltaForMonth(db *sql.DB, uid uidT, date time.Time) (delta int, err error) {
+	som := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, date.Location())
+	eod := nextMidnight(date)
+	delta, err = getWorked(db, uid, som, eod)
+	if err != nil {
+		return delta, stacktrace.Propagate(err, "")
+	}
+
+	expected, err := loadExpectedTime(db, uid, som, date)
+	if err != nil {
+		return delta, stacktrace.Propagate(err, "failed to get expected time")
+	}
+	for x := som; x.Before(eod); x = x.AddDate(0, 0, 1) { // not 24 hours, days around DST changes are shorter or longer
+		delta -= expected.forDay(x)
 	}
 
 	return delta, nil
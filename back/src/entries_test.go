@@ -0,0 +1,240 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitByDay(t *testing.T) {
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	next := day.AddDate(0, 0, 1)
+	after := day.AddDate(0, 0, 2)
+	at := func(d time.Time, hours int) int {
+		return int(d.Add(time.Duration(hours) * time.Hour).Unix())
+	}
+
+	tests := []struct {
+		name        string
+		from, to    int
+		wholeShifts bool
+		want        map[int64]int
+	}{
+		{"within a day", at(day, 8), at(day, 16), false, map[int64]int{day.Unix(): 8 * 3600}},
+		{"night shift", at(day, 22), at(next, 6), false, map[int64]int{day.Unix(): 2 * 3600, next.Unix(): 6 * 3600}},
+		{"night shift as a whole", at(day, 22), at(next, 6), true, map[int64]int{day.Unix(): 8 * 3600}},
+		{"until midnight", at(day, 22), at(next, 0), false, map[int64]int{day.Unix(): 2 * 3600}},
+		{"from midnight", at(next, 0), at(next, 6), false, map[int64]int{next.Unix(): 6 * 3600}},
+		{"over a whole day", at(day, 22), at(after, 6), false,
+			map[int64]int{day.Unix(): 2 * 3600, next.Unix(): 24 * 3600, after.Unix(): 6 * 3600}},
+		{"empty", at(day, 8), at(day, 8), false, map[int64]int{day.Unix(): 0}},
+	}
+
+	for _, test := range tests {
+		got := splitByDay(test.from, test.to, time.UTC, test.wholeShifts)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: splitByDay = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestGetWorkedByDayWholeShifts(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	uid := newTestUser(t, db, "test@invalid", []role{roleEmployee})
+
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	next := day.AddDate(0, 0, 1)
+	from := int(day.Add(22 * time.Hour).Unix())
+	_, err := addEntry(db, uid, from, from+8*3600, true, systemActor, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(start time.Time, want map[int64]int) {
+		t.Helper()
+		got, err := getWorkedByDay(db, uid, start, day.AddDate(0, 0, 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("getWorkedByDay from %s = %v, want %v", start.Format(dateLayout), got, want)
+		}
+	}
+
+	check(day, map[int64]int{day.Unix(): 2 * 3600, next.Unix(): 6 * 3600})
+	check(next, map[int64]int{next.Unix(): 6 * 3600})
+
+	team, err := createTeam(db, "Nights", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setTeamMember(db, team, uid, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	whole := true
+	err = setTeamWholeShifts(db, team, &whole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(day, map[int64]int{day.Unix(): 8 * 3600})
+	check(next, map[int64]int{}) // the shift belongs to the day before
+}
+
+func TestSplitByDayDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(year int, month time.Month, day, hour int) int {
+		return int(time.Date(year, month, day, hour, 0, 0, 0, loc).Unix())
+	}
+	day := func(year int, month time.Month, day int) int64 {
+		return time.Date(year, month, day, 0, 0, 0, 0, loc).Unix()
+	}
+
+	tests := []struct {
+		name        string
+		from, to    int
+		wholeShifts bool
+		want        map[int64]int
+	}{
+		// the clocks go forward at 02:00, so 00:00 to 06:00 is 5 hours
+		{"night shift into spring forward", at(2026, 3, 28, 22), at(2026, 3, 29, 6), false,
+			map[int64]int{day(2026, 3, 28): 2 * 3600, day(2026, 3, 29): 5 * 3600}},
+		{"spring forward as a whole", at(2026, 3, 28, 22), at(2026, 3, 29, 6), true,
+			map[int64]int{day(2026, 3, 28): 7 * 3600}},
+		{"all of spring forward", at(2026, 3, 29, 0), at(2026, 3, 30, 0), false,
+			map[int64]int{day(2026, 3, 29): 23 * 3600}},
+		// the clocks go back at 03:00, so 00:00 to 06:00 is 7 hours
+		{"night shift into fall back", at(2026, 10, 24, 22), at(2026, 10, 25, 6), false,
+			map[int64]int{day(2026, 10, 24): 2 * 3600, day(2026, 10, 25): 7 * 3600}},
+		{"night shift out of fall back", at(2026, 10, 25, 22), at(2026, 10, 26, 6), false,
+			map[int64]int{day(2026, 10, 25): 2 * 3600, day(2026, 10, 26): 6 * 3600}},
+		{"all of fall back", at(2026, 10, 25, 0), at(2026, 10, 26, 0), false,
+			map[int64]int{day(2026, 10, 25): 25 * 3600}},
+	}
+
+	for _, test := range tests {
+		got := splitByDay(test.from, test.to, loc, test.wholeShifts)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: splitByDay = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestGetDeltaForMonthDST(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	uid := newTestUser(t, db, "test@invalid", []role{roleEmployee})
+	err := setSchedule(db, uid, schedule{"2026-01-01", [7]int{3600, 3600, 3600, 3600, 3600, 3600, 3600}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loc, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []int{29, 30} {
+		from := time.Date(2026, 3, d, 0, 0, 0, 0, loc)
+		_, err = addEntry(db, uid, int(from.Unix()), int(nextMidnight(from).Unix()), true, systemActor, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	from := time.Date(2026, 10, 25, 0, 0, 0, 0, loc)
+	_, err = addEntry(db, uid, int(from.Unix()), int(nextMidnight(from).Unix()), true, systemActor, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		date time.Time
+		want int // hours
+	}{
+		{time.Date(2026, 3, 28, 12, 0, 0, 0, loc), -28},
+		{time.Date(2026, 3, 29, 12, 0, 0, 0, loc), 23 - 29},
+		{time.Date(2026, 3, 31, 12, 0, 0, 0, loc), 23 + 24 - 31},
+		// every day is expected once, stepping by 24 hours would count the 25th twice
+		{time.Date(2026, 10, 31, 12, 0, 0, 0, loc), 25 - 31},
+	}
+
+	for _, test := range tests {
+		delta, err := getDeltaForMonth(db, uid, test.date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delta != test.want*3600 {
+			t.Errorf("getDeltaForMonth(%s) = %vh, want %dh", test.date.Format(dateLayout), float64(delta)/3600, test.want)
+		}
+	}
+}
+
+func TestExpectedTime(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	uid := newTestUser(t, db, "test@invalid", []role{roleEmployee})
+	err := setSchedule(db, uid, schedule{"2026-01-01", [7]int{0, 28800, 28800, 28800, 28800, 28800, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setSchedule(db, uid, schedule{"2026-03-09", [7]int{0, 14400, 14400, 14400, 14400, 14400, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []holiday{{"2026-03-04", "Full", false}, {"2026-03-05", "Half", true}} {
+		err = addHoliday(db, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, l := range []leaveRequest{
+		{UID: uid, Type: "sick", From: "2026-03-10", To: "2026-03-11"},
+		{UID: uid, Type: "sick", From: "2026-03-12", To: "2026-03-12", Half: true},
+		{UID: uid, Type: "sick", From: "2026-03-13", To: "2026-03-13"}, // left pending
+	} {
+		lid, err := requestLeave(db, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.To != "2026-03-13" {
+			err = decideLeave(db, lid, uid, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	want := map[string]int{
+		"2026-03-02": 28800, "2026-03-03": 28800, "2026-03-04": 0, "2026-03-05": 14400, "2026-03-06": 28800,
+		"2026-03-07": 0, "2026-03-08": 0,
+		"2026-03-09": 14400, "2026-03-10": 0, "2026-03-11": 0, "2026-03-12": 7200, "2026-03-13": 14400,
+		"2026-03-14": 0, "2026-03-15": 0,
+	}
+
+	from := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 0, 13)
+	e, err := loadExpectedTime(db, uid, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format(dateLayout)
+		if got := e.forDay(day); got != want[date] {
+			t.Errorf("forDay(%s) = %d, want %d", date, got, want[date])
+		}
+		single, err := getExpectedForDay(db, uid, day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if single != want[date] {
+			t.Errorf("getExpectedForDay(%s) = %d, want %d", date, single, want[date])
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+const dateLayout = "2006-01-02"
+
+// maxEventDays is how many days an imported event can span, a longer one is most likely a mistake
+// and would otherwise add a holiday for every day of it
+const maxEventDays = 366
+
+type holiday struct {
+	Date string `json:"date"`
+	Name string `json:"name"`
+	Half bool   `json:"half"`
+}
+
+// holidayRule describes a holiday that falls on the same day every year
+// or, if easter is set, on a fixed offset in days from Easter Sunday
+type holidayRule struct {
+	name   string
+	month  time.Month
+	day    int
+	easter bool
+	offset int
+	half   bool
+	since  int // first year the holiday is observed, 0 if it always was
+}
+
+var holidayRuleSets = map[string][]holidayRule{
+	"pl": {
+		{name: "New Year's Day", month: time.January, day: 1},
+		{name: "Epiphany", month: time.January, day: 6, since: 2011},
+		{name: "Easter Sunday", easter: true, offset: 0},
+		{name: "Easter Monday", easter: true, offset: 1},
+		{name: "Labour Day", month: time.May, day: 1},
+		{name: "Constitution Day", month: time.May, day: 3},
+		{name: "Pentecost", easter: true, offset: 49},
+		{name: "Corpus Christi", easter: true, offset: 60},
+		{name: "Assumption Day", month: time.August, day: 15},
+		{name: "All Saints' Day", month: time.November, day: 1},
+		{name: "Independence Day", month: time.November, day: 11},
+		{name: "Christmas Eve", month: time.December, day: 24, since: 2025},
+		{name: "Christmas Day", month: time.December, day: 25},
+		{name: "Second Day of Christmas", month: time.December, day: 26},
+	},
+	"de": {
+		{name: "Neujahr", month: time.January, day: 1},
+		{name: "Karfreitag", easter: true, offset: -2},
+		{name: "Ostermontag", easter: true, offset: 1},
+		{name: "Tag der Arbeit", month: time.May, day: 1},
+		{name: "Christi Himmelfahrt", easter: true, offset: 39},
+		{name: "Pfingstmontag", easter: true, offset: 50},
+		{name: "Tag der Deutschen Einheit", month: time.October, day: 3},
+		{name: "Erster Weihnachtstag", month: time.December, day: 25},
+		{name: "Zweiter Weihnachtstag", month: time.December, day: 26},
+	},
+}
+
+// easterSunday uses the anonymous Gregorian algorithm
+func easterSunday(year int) time.Time {
+	a := year % 19
+	b := year / 100
+	c := year % 100
+	d := b / 4
+	e := b % 4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i := c / 4
+	k := c % 4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+}
+
+func generateHolidays(rules []holidayRule, year int) (holidays []holiday) {
+	easter := easterSunday(year)
+	for _, rule := range rules {
+		if rule.since > year {
+			continue
+		}
+
+		var date time.Time
+		if rule.easter {
+			date = easter.AddDate(0, 0, rule.offset)
+		} else {
+			date = time.Date(year, rule.month, rule.day, 0, 0, 0, 0, time.UTC)
+		}
+		holidays = append(holidays, holiday{date.Format(dateLayout), rule.name, rule.half})
+	}
+	return holidays
+}
+
+// parseICS extracts all-day events from an iCalendar file, an event spanning
+// several days (DTEND is exclusive) becomes one holiday per day, see maxEventDays
+func parseICS(r io.Reader) (holidays []holiday, err error) {
+	lines := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			// folded line, see RFC 5545 section 3.1
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read calendar")
+	}
+
+	parseDate := func(value string) (time.Time, error) {
+		if len(value) < 8 {
+			return time.Time{}, stacktrace.NewError("malformed date " + value)
+		}
+		return time.Parse("20060102", value[:8])
+	}
+
+	inEvent := false
+	var start, end, summary string
+	for _, line := range lines {
+		colon := strings.Index(line, ":")
+		if colon == -1 {
+			continue
+		}
+		name := strings.ToUpper(line[:colon])
+		if semicolon := strings.Index(name, ";"); semicolon != -1 {
+			name = name[:semicolon] // drop parameters such as VALUE=DATE
+		}
+		value := line[colon+1:]
+
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			inEvent = true
+			start, end, summary = "", "", ""
+		case name == "END" && value == "VEVENT":
+			inEvent = false
+			from, err := parseDate(start)
+			if err != nil {
+				return nil, stacktrace.Propagate(err, "failed to parse DTSTART")
+			}
+			to := from.AddDate(0, 0, 1)
+			if end != "" {
+				to, err = parseDate(end)
+				if err != nil {
+					return nil, stacktrace.Propagate(err, "failed to parse DTEND")
+				}
+			}
+			if to.After(from.AddDate(0, 0, maxEventDays)) {
+				return nil, stacktrace.NewError("event longer than " + strconv.Itoa(maxEventDays) + " days")
+			}
+			for x := from; x.Before(to); x = x.AddDate(0, 0, 1) {
+				holidays = append(holidays, holiday{x.Format(dateLayout), summary, false})
+			}
+		case !inEvent:
+		case name == "DTSTART":
+			start = value
+		case name == "DTEND":
+			end = value
+		case name == "SUMMARY":
+			summary = strings.NewReplacer(`\n`, " ", `\N`, " ", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+		}
+	}
+
+	return holidays, nil
+}
+
+func addHoliday(db execer, h holiday) (err error) {
+	_, err = time.Parse(dateLayout, h.Date)
+	if err != nil {
+		return stacktrace.Propagate(err, "malformed date")
+	}
+
+	halfInt := 0
+	if h.Half {
+		halfInt = 1
+	}
+
+	_, err = db.Exec(
+		`INSERT OR REPLACE INTO holidays (date, name, half)
+			VALUES (?1, ?2, ?3)`, h.Date, h.Name, halfInt)
+	return stacktrace.Propagate(err, "failed to add holiday")
+}
+
+func holidayTarget(date string) string {
+	return "holiday:" + date
+}
+
+// addHolidays adds them all or none, see addHoliday
+func addHolidays(tx *sql.Tx, holidays []holiday) (err error) {
+	for _, h := range holidays {
+		err = addHoliday(tx, h)
+		if err != nil {
+			return stacktrace.Propagate(err, "")
+		}
+	}
+	return nil
+}
+
+func deleteHoliday(db execer, date string) (err error) {
+	_, err = db.Exec("DELETE FROM holidays WHERE date = ?", date)
+	return stacktrace.Propagate(err, "failed to delete holiday")
+}
+
+// listHolidays lists holidays between from and to inclusive, both formatted as dateLayout
+func listHolidays(db *sql.DB, from, to string) (holidays []holiday, err error) {
+	rows, err := db.Query("SELECT date, name, half FROM holidays WHERE date >= ?1 AND date <= ?2 ORDER BY date", from, to)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list holidays")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var h holiday
+		err = rows.Scan(&h.Date, &h.Name, &h.Half)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		holidays = append(holidays, h)
+	}
+
+	return holidays, nil
+}
+
+func getHoliday(db execer, date time.Time) (h holiday, ok bool, err error) {
+	err = db.QueryRow("SELECT date, name, half FROM holidays WHERE date = ?", date.Format(dateLayout)).Scan(&h.Date, &h.Name, &h.Half)
+	if err == sql.ErrNoRows {
+		return h, false, nil
+	}
+	if err != nil {
+		return h, false, stacktrace.Propagate(err, "failed to get holiday")
+	}
+	return h, true, nil
+}
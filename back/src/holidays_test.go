@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEasterSunday(t *testing.T) {
+	tests := []struct {
+		year int
+		want string
+	}{
+		{2000, "2000-04-23"},
+		{2008, "2008-03-23"},
+		{2011, "2011-04-24"},
+		{2024, "2024-03-31"},
+		{2025, "2025-04-20"},
+		{2038, "2038-04-25"},
+	}
+
+	for _, test := range tests {
+		got := easterSunday(test.year).Format(dateLayout)
+		if got != test.want {
+			t.Errorf("easterSunday(%d) = %s, want %s", test.year, got, test.want)
+		}
+	}
+}
+
+func TestParseICS(t *testing.T) {
+	ics := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"BEGIN:VEVENT",
+		"DTSTART;VALUE=DATE:20251225",
+		"DTEND;VALUE=DATE:20251227",
+		"SUMMARY:Christmas\\, and the day ",
+		" after",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"DTSTART;VALUE=DATE:20260101",
+		"SUMMARY:New Year",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"DTSTART:20260501T000000Z",
+		"DTEND:20260502T000000Z",
+		"SUMMARY:Labour",
+		"\t Day",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+
+	holidays, err := parseICS(strings.NewReader(ics))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []holiday{
+		{"2025-12-25", "Christmas, and the day after", false},
+		{"2025-12-26", "Christmas, and the day after", false},
+		{"2026-01-01", "New Year", false},
+		{"2026-05-01", "Labour Day", false},
+	}
+	if len(holidays) != len(want) {
+		t.Fatalf("got %d holidays, want %d: %v", len(holidays), len(want), holidays)
+	}
+	for i := range want {
+		if holidays[i] != want[i] {
+			t.Errorf("holiday %d = %+v, want %+v", i, holidays[i], want[i])
+		}
+	}
+}
+
+func TestParseICSMalformed(t *testing.T) {
+	tests := []struct {
+		name, ics string
+	}{
+		{"malformed DTSTART", "BEGIN:VEVENT\r\nDTSTART;VALUE=DATE:2025\r\nEND:VEVENT\r\n"},
+		{"event spanning decades", "BEGIN:VEVENT\r\nDTSTART;VALUE=DATE:20000101\r\nDTEND;VALUE=DATE:20500101\r\nEND:VEVENT\r\n"},
+	}
+
+	for _, test := range tests {
+		_, err := parseICS(strings.NewReader(test.ics))
+		if err == nil {
+			t.Errorf("%s was accepted", test.name)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+type lidT int
+
+type leaveType struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+	Paid bool   `json:"paid"`
+}
+
+type leaveRequest struct {
+	LID             lidT   `json:"lid"`
+	UID             uidT   `json:"uid"`
+	Type            string `json:"type"`
+	From            string `json:"from"`
+	To              string `json:"to"`
+	Half            bool   `json:"half"`
+	Reason          string `json:"reason"`
+	Status          string `json:"status"`
+	RequestedAt     int    `json:"requestedAt"`
+	DecidedBy       uidT   `json:"decidedBy"` // 0 if undecided
+	DecidedAt       int    `json:"decidedAt"` // see above
+	OverlapsEntries bool   `json:"overlapsEntries"`
+}
+
+var (
+	errLeaveOverlap     = errors.New("leave overlaps another leave request")
+	errLeaveNotPending  = errors.New("leave request is not pending")
+	errUnknownLeaveType = errors.New("unknown leave type")
+)
+
+func listLeaveTypes(db execer) (types []leaveType, err error) {
+	rows, err := db.Query("SELECT code, name, paid FROM leave_types ORDER BY code")
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list leave types")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t leaveType
+		err = rows.Scan(&t.Code, &t.Name, &t.Paid)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		types = append(types, t)
+	}
+
+	return types, nil
+}
+
+func addLeaveType(db execer, t leaveType) (err error) {
+	paidInt := 0
+	if t.Paid {
+		paidInt = 1
+	}
+
+	_, err = db.Exec(
+		`INSERT OR REPLACE INTO leave_types (code, name, paid)
+			VALUES (?1, ?2, ?3)`, t.Code, t.Name, paidInt)
+	return stacktrace.Propagate(err, "failed to add leave type")
+}
+
+func requestLeave(db *sql.DB, l leaveRequest) (lid lidT, err error) {
+	tx, err := db.Begin()
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+	if err != nil {
+		return -1, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+
+	err = tx.QueryRow("SELECT 1 FROM leave_types WHERE code = ?", l.Type).Scan(new(int))
+	if err == sql.ErrNoRows {
+		rollback()
+		return -1, stacktrace.Propagate(errUnknownLeaveType, l.Type)
+	}
+	if err != nil {
+		rollback()
+		return -1, stacktrace.Propagate(err, "failed to check leave type")
+	}
+
+	err = tx.QueryRow(
+		`SELECT 1 FROM leave WHERE uid = ?1 AND status IN ('P', 'A')
+			AND from_date <= ?3 AND to_date >= ?2`, l.UID, l.From, l.To).Scan(new(int))
+	if err == nil {
+		rollback()
+		return -1, stacktrace.Propagate(errLeaveOverlap, "")
+	}
+	if err != sql.ErrNoRows {
+		rollback()
+		return -1, stacktrace.Propagate(err, "failed to check for overlapping leave")
+	}
+
+	halfInt := 0
+	if l.Half {
+		halfInt = 1
+	}
+
+	res, err := tx.Exec(
+		`INSERT INTO leave (uid, type, from_date, to_date, half, reason, status, requested_unix_s)
+			VALUES (?1, ?2, ?3, ?4, ?5, ?6, 'P', ?7)`, l.UID, l.Type, l.From, l.To, halfInt, l.Reason, time.Now().Unix())
+	if err != nil {
+		rollback()
+		return -1, stacktrace.Propagate(err, "failed to insert a row into the leave table")
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		rollback()
+		return -1, stacktrace.Propagate(err, "failed to get lid")
+	}
+
+	return lidT(id), stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// leaveOverlapsEntries checks whether the user has any valid entries on the days the leave covers,
+// which are those of the user's time zone
+func leaveOverlapsEntries(db *sql.DB, l leaveRequest, fallback *time.Location) (overlaps bool, err error) {
+	loc, err := getUserLocation(db, l.UID, fallback)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "")
+	}
+
+	from, err := time.ParseInLocation(dateLayout, l.From, loc)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "malformed date")
+	}
+	to, err := time.ParseInLocation(dateLayout, l.To, loc)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "malformed date")
+	}
+	to = to.AddDate(0, 0, 1)
+
+	err = db.QueryRow(
+		`SELECT 1 FROM entries WHERE uid = ?1 AND valid = 1
+			AND from_unix_s < ?3 AND to_unix_s > ?2`, l.UID, from.Unix(), to.Unix()).Scan(new(int))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, stacktrace.Propagate(err, "failed to check for overlapping entries")
+}
+
+// listLeave lists leave requests of the given user, or of everyone if uid is 0,
+// optionally only the ones with the given status or of the members of the manager's teams
+func listLeave(db *sql.DB, uid uidT, status string, managedBy uidT, loc *time.Location) (requests []leaveRequest, err error) {
+	rows, err := db.Query(
+		`SELECT lid, uid, type, from_date, to_date, half, reason, status,
+			requested_unix_s, COALESCE(decided_by, 0), COALESCE(decided_unix_s, 0)
+			FROM leave WHERE (?1 = 0 OR uid = ?1) AND (?2 = '' OR status = ?2)
+			AND (?3 = 0 OR uid IN (SELECT uid FROM managed_users WHERE manager_uid = ?3))
+			ORDER BY from_date`, uid, status, managedBy)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list leave")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l leaveRequest
+		err = rows.Scan(&l.LID, &l.UID, &l.Type, &l.From, &l.To, &l.Half, &l.Reason, &l.Status,
+			&l.RequestedAt, &l.DecidedBy, &l.DecidedAt)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		requests = append(requests, l)
+	}
+	rows.Close()
+
+	for i := range requests {
+		requests[i].OverlapsEntries, err = leaveOverlapsEntries(db, requests[i], loc)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to check for overlapping entries")
+		}
+	}
+
+	return requests, nil
+}
+
+func getLeave(db *sql.DB, lid lidT, loc *time.Location) (l leaveRequest, err error) {
+	err = db.QueryRow(
+		`SELECT lid, uid, type, from_date, to_date, half, reason, status,
+			requested_unix_s, COALESCE(decided_by, 0), COALESCE(decided_unix_s, 0)
+			FROM leave WHERE lid = ?`, lid).Scan(&l.LID, &l.UID, &l.Type, &l.From, &l.To, &l.Half, &l.Reason, &l.Status,
+		&l.RequestedAt, &l.DecidedBy, &l.DecidedAt)
+	if err != nil {
+		return l, stacktrace.Propagate(err, "failed to get leave")
+	}
+
+	l.OverlapsEntries, err = leaveOverlapsEntries(db, l, loc)
+	return l, stacktrace.Propagate(err, "failed to check for overlapping entries")
+}
+
+func decideLeave(db execer, lid lidT, decider uidT, approve bool) (err error) {
+	status := "R"
+	if approve {
+		status = "A"
+	}
+
+	res, err := db.Exec(
+		`UPDATE leave SET status = ?1, decided_by = ?2, decided_unix_s = ?3
+			WHERE lid = ?4 AND status = 'P'`, status, decider, time.Now().Unix(), lid)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update leave")
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get affected rows")
+	}
+	if affected == 0 {
+		return stacktrace.Propagate(errLeaveNotPending, "")
+	}
+	return nil
+}
+
+func cancelLeave(db *sql.DB, uid uidT, lid lidT) (err error) {
+	res, err := db.Exec("UPDATE leave SET status = 'C' WHERE lid = ?1 AND uid = ?2 AND status = 'P'", lid, uid)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to cancel leave")
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get affected rows")
+	}
+	if affected == 0 {
+		return stacktrace.Propagate(errLeaveNotPending, "")
+	}
+	return nil
+}
+
+// listApprovedLeave lists the user's approved leave that overlaps the dates from and to, both inclusive
+func listApprovedLeave(db *sql.DB, uid uidT, from, to string) (requests []leaveRequest, err error) {
+	rows, err := db.Query(
+		`SELECT lid, type, from_date, to_date, half FROM leave
+			WHERE uid = ?1 AND status = 'A' AND from_date <= ?3 AND to_date >= ?2 ORDER BY from_date, lid`, uid, from, to)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list leave")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		l := leaveRequest{UID: uid, Status: "A"}
+		err = rows.Scan(&l.LID, &l.Type, &l.From, &l.To, &l.Half)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		requests = append(requests, l)
+	}
+
+	return requests, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/ed25519"
+)
+
+// auditHash covers every field of the record and the hash of the one before it, so changing, removing or
+// reordering any record changes the hashes of all the ones after it. Before and after are hashed as stored
+func auditHash(a auditRecord) string {
+	raw := func(js json.RawMessage) interface{} {
+		if js == nil {
+			return nil
+		}
+		return string(js)
+	}
+
+	js, _ := json.Marshal([]interface{}{
+		a.Prev, a.ID, a.At, a.Actor, a.Action, a.UID, a.Target, raw(a.Before), raw(a.After), a.Reason})
+	hash := sha256.Sum256(js)
+	return hex.EncodeToString(hash[:])
+}
+
+type ledgerBreak struct {
+	ID      int    `json:"id"` // of the first audit record that doesn't match, 0 if it's about an entry
+	EID     eidT   `json:"eid"`
+	Problem string `json:"problem"`
+}
+
+type ledgerReport struct {
+	Records  int          `json:"records"`
+	LastID   int          `json:"lastId"`
+	LastHash string       `json:"lastHash"`
+	Break    *ledgerBreak `json:"break"` // null if the ledger is intact
+}
+
+// verifyLedger walks the audit log checking every hash, and then checks that every entry
+// is exactly as the last audit record about it says it should be
+func verifyLedger(db *sql.DB) (report ledgerReport, err error) {
+	rows, err := db.Query(`SELECT ` + auditColumns + ` FROM audit_log ORDER BY audit_id`)
+	if err != nil {
+		return report, stacktrace.Propagate(err, "failed to list audit records")
+	}
+	defer rows.Close()
+
+	latest := make(map[string]auditRecord) // the last record of every entry
+	for rows.Next() {
+		a, err := scanAuditRecord(rows)
+		if err != nil {
+			return report, stacktrace.Propagate(err, "")
+		}
+
+		if a.Prev != report.LastHash {
+			report.Break = &ledgerBreak{ID: a.ID, Problem: "the record before it is missing or was changed"}
+			return report, nil
+		}
+		if auditHash(a) != a.Hash {
+			report.Break = &ledgerBreak{ID: a.ID, Problem: "the record was changed"}
+			return report, nil
+		}
+
+		report.Records++
+		report.LastID = a.ID
+		report.LastHash = a.Hash
+		if strings.HasPrefix(a.Target, "entry:") {
+			latest[a.Target] = a
+		}
+	}
+	rows.Close()
+
+	entries, err := db.Query("SELECT uid, " + entryColumns + " FROM entries ORDER BY eid")
+	if err != nil {
+		return report, stacktrace.Propagate(err, "failed to list entries")
+	}
+	defer entries.Close()
+
+	for entries.Next() {
+		var uid uidT
+		var e entry
+		err = entries.Scan(&uid, &e.EID, &e.From, &e.To, &e.Valid, &e.Policy, &e.PolicyReason)
+		if err != nil {
+			return report, stacktrace.Propagate(err, "failed to scan row")
+		}
+
+		target := entryTarget(e.EID)
+		a, ok := latest[target]
+		delete(latest, target)
+		if !ok || a.After == nil {
+			report.Break = &ledgerBreak{EID: e.EID, Problem: "the entry isn't in the audit log"}
+			return report, nil
+		}
+		var recorded entry
+		err = json.Unmarshal(a.After, &recorded)
+		if err != nil || recorded != e || a.UID != uid {
+			report.Break = &ledgerBreak{EID: e.EID, Problem: "the entry differs from the audit log"}
+			return report, nil
+		}
+	}
+
+	var removed eidT
+	for target, a := range latest {
+		eid, _ := strconv.Atoi(strings.TrimPrefix(target, "entry:"))
+		if a.After != nil && (removed == 0 || eidT(eid) < removed) {
+			removed = eidT(eid)
+		}
+	}
+	if removed != 0 {
+		report.Break = &ledgerBreak{EID: removed, Problem: "the entry was removed without a record of it"}
+	}
+
+	return report, nil
+}
+
+// checkpoint is handed out to auditors, as long as a later verification finds the same hash
+// under the same id, nothing up to that point has been changed since it was made
+type checkpoint struct {
+	LastID    int    `json:"lastId"`
+	LastHash  string `json:"lastHash"`
+	At        int    `json:"at"`
+	PublicKey string `json:"publicKey"` // base64, empty if no signing key is configured
+	Signature string `json:"signature"` // see above
+}
+
+func (c checkpoint) message() []byte {
+	return []byte("wms2 checkpoint\n" + strconv.Itoa(c.LastID) + "\n" + c.LastHash + "\n" + strconv.Itoa(c.At))
+}
+
+// parseSigningKey reads the base64 encoded 32 byte seed from the config
+func parseSigningKey(seed string) (key ed25519.PrivateKey, err error) {
+	raw, err := base64.StdEncoding.DecodeString(seed)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "malformed signing key")
+	}
+	if len(raw) != ed25519.SeedSize {
+		return nil, stacktrace.NewError("the signing key has to be %d bytes long", ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(raw), nil
+}
+
+// createCheckpoint verifies the ledger first, a broken one can't be vouched for
+func createCheckpoint(db *sql.DB, key ed25519.PrivateKey) (c checkpoint, report ledgerReport, err error) {
+	report, err = verifyLedger(db)
+	if err != nil || report.Break != nil {
+		return c, report, stacktrace.Propagate(err, "failed to verify ledger")
+	}
+
+	c = checkpoint{LastID: report.LastID, LastHash: report.LastHash, At: int(time.Now().Unix())}
+	if key != nil {
+		c.PublicKey = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+		c.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, c.message()))
+	}
+	return c, report, nil
+}
+
+// verifyCheckpoint checks that the checkpoint was signed with the configured key, if there is one, and that the
+// ledger still has the same hash at that point. The key in the checkpoint itself isn't trusted, anyone could have
+// made one and signed it. The stored hash can only be trusted if the report found no break up to that point
+func verifyCheckpoint(db *sql.DB, c checkpoint, report ledgerReport, key ed25519.PrivateKey) (problem string, err error) {
+	if key != nil {
+		publicKey := key.Public().(ed25519.PublicKey)
+		if c.Signature == "" {
+			return "the checkpoint isn't signed", nil
+		}
+		if c.PublicKey != base64.StdEncoding.EncodeToString(publicKey) {
+			return "the checkpoint was signed with another key", nil
+		}
+		signature, err := base64.StdEncoding.DecodeString(c.Signature)
+		if err != nil || !ed25519.Verify(publicKey, c.message(), signature) {
+			return "the signature doesn't match", nil
+		}
+	}
+
+	if report.Break != nil && report.Break.ID != 0 && report.Break.ID <= c.LastID {
+		return fmt.Sprintf("the ledger is broken at record %d", report.Break.ID), nil
+	}
+
+	var hash string
+	err = db.QueryRow("SELECT COALESCE(hash, '') FROM audit_log WHERE audit_id = ?", c.LastID).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return fmt.Sprintf("record %d is missing", c.LastID), nil
+	}
+	if err != nil {
+		return "", stacktrace.Propagate(err, "failed to get record")
+	}
+	if hash != c.LastHash {
+		return fmt.Sprintf("record %d has a different hash", c.LastID), nil
+	}
+	return "", nil
+}
+
+// printLedgerVerification verifies the ledger and then every checkpoint file given against the signing key
+func printLedgerVerification(db *sql.DB, checkpointPaths []string, key ed25519.PrivateKey) (intact bool, err error) {
+	report, err := verifyLedger(db)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "")
+	}
+
+	intact = report.Break == nil
+	if intact {
+		fmt.Printf("ledger intact, %d record(s), last %d %s\n", report.Records, report.LastID, report.LastHash)
+	} else if report.Break.ID != 0 {
+		fmt.Printf("ledger broken at record %d: %s\n", report.Break.ID, report.Break.Problem)
+	} else {
+		fmt.Printf("ledger broken at entry %d: %s\n", report.Break.EID, report.Break.Problem)
+	}
+
+	for _, path := range checkpointPaths {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return false, stacktrace.Propagate(err, "failed to read checkpoint")
+		}
+		var c checkpoint
+		err = json.Unmarshal(raw, &c)
+		if err != nil {
+			return false, stacktrace.Propagate(err, "failed to parse checkpoint")
+		}
+
+		problem, err := verifyCheckpoint(db, c, report, key)
+		if err != nil {
+			return false, stacktrace.Propagate(err, "")
+		}
+		if problem != "" {
+			intact = false
+			fmt.Printf("%s doesn't match: %s\n", path, problem)
+		} else {
+			fmt.Printf("%s matches\n", path)
+		}
+	}
+	return intact, nil
+}
+
+func printCheckpoint(db *sql.DB, key ed25519.PrivateKey) (err error) {
+	c, report, err := createCheckpoint(db, key)
+	if err != nil {
+		return stacktrace.Propagate(err, "")
+	}
+	if report.Break != nil {
+		return stacktrace.NewError("the ledger is broken, run verify for details")
+	}
+
+	js, _ := json.MarshalIndent(c, "", "\t")
+	fmt.Println(string(js))
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// newTestLedger makes a user with three entries, each added with its own audit record, the second one is edited
+// afterwards so that the audit log has records 1 to 4 and the entries 1 to 3
+func newTestLedger(t *testing.T) (db *sql.DB, cleanup func()) {
+	db, cleanup = newTestDB(t)
+
+	uid := newTestUser(t, db, "test@invalid", []role{roleEmployee})
+
+	day := 1767225600 // 2026-01-01 00:00 UTC
+	for i := 0; i < 3; i++ {
+		from := day + i*86400 + 8*3600
+		_, err := addEntry(db, uid, from, from+8*3600, true, systemActor, "test")
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+	err := editEntry(db, 2, day+86400+9*3600, day+86400+17*3600, systemActor, "late")
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return db, cleanup
+}
+
+// tamper makes changes nobody can make through the application, the triggers are dropped the way
+// someone with access to the database file could
+func tamper(t *testing.T, db *sql.DB, statements ...string) {
+	t.Helper()
+	statements = append([]string{
+		"DROP TRIGGER audit_log_no_update",
+		"DROP TRIGGER audit_log_no_delete",
+	}, statements...)
+	for _, s := range statements {
+		_, err := db.Exec(s)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+}
+
+func TestVerifyLedgerIntact(t *testing.T) {
+	db, cleanup := newTestLedger(t)
+	defer cleanup()
+
+	report, err := verifyLedger(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Break != nil {
+		t.Fatalf("intact ledger is broken: %+v", *report.Break)
+	}
+	if report.Records != 4 || report.LastID != 4 || report.LastHash == "" {
+		t.Errorf("report = %+v", report)
+	}
+}
+
+func TestVerifyLedgerTampered(t *testing.T) {
+	tests := []struct {
+		name       string
+		statements []string
+		want       ledgerBreak
+	}{
+		{"modified record", []string{"UPDATE audit_log SET reason = 'on time' WHERE audit_id = 4"},
+			ledgerBreak{ID: 4, Problem: "the record was changed"}},
+		{"deleted record", []string{"DELETE FROM audit_log WHERE audit_id = 2"},
+			ledgerBreak{ID: 3, Problem: "the record before it is missing or was changed"}},
+		{"reordered records", []string{
+			"UPDATE audit_log SET audit_id = -2 WHERE audit_id = 2",
+			"UPDATE audit_log SET audit_id = 2 WHERE audit_id = 3",
+			"UPDATE audit_log SET audit_id = 3 WHERE audit_id = -2"},
+			ledgerBreak{ID: 2, Problem: "the record before it is missing or was changed"}},
+		{"modified entry", []string{"UPDATE entries SET to_unix_s = to_unix_s + 3600 WHERE eid = 2"},
+			ledgerBreak{EID: 2, Problem: "the entry differs from the audit log"}},
+		{"deleted entry", []string{"DELETE FROM entries WHERE eid = 2"},
+			ledgerBreak{EID: 2, Problem: "the entry was removed without a record of it"}},
+		{"reordered entries", []string{
+			"UPDATE entries SET eid = -1 WHERE eid = 1",
+			"UPDATE entries SET eid = 1 WHERE eid = 3",
+			"UPDATE entries SET eid = 3 WHERE eid = -1"},
+			ledgerBreak{EID: 1, Problem: "the entry differs from the audit log"}},
+		{"added entry", []string{"INSERT INTO entries (uid, from_unix_s, to_unix_s, valid) VALUES (1, 0, 3600, 1)"},
+			ledgerBreak{EID: 4, Problem: "the entry isn't in the audit log"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, cleanup := newTestLedger(t)
+			defer cleanup()
+			tamper(t, db, test.statements...)
+
+			report, err := verifyLedger(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Break == nil {
+				t.Fatal("tampering wasn't noticed")
+			}
+			if *report.Break != test.want {
+				t.Errorf("break = %+v, want %+v", *report.Break, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	db, cleanup := newTestLedger(t)
+	defer cleanup()
+
+	key, err := parseSigningKey(base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _, err := createCheckpoint(db, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.LastID != 4 || c.Signature == "" {
+		t.Fatalf("checkpoint = %+v", c)
+	}
+
+	verify := func(c checkpoint, key ed25519.PrivateKey) string {
+		t.Helper()
+		report, err := verifyLedger(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		problem, err := verifyCheckpoint(db, c, report, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return problem
+	}
+
+	if problem := verify(c, key); problem != "" {
+		t.Errorf("fresh checkpoint: %s", problem)
+	}
+
+	// later records don't affect it
+	_, err = addEntry(db, 1, 0, 3600, true, systemActor, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problem := verify(c, key); problem != "" {
+		t.Errorf("checkpoint after more records: %s", problem)
+	}
+
+	forged := c
+	forged.LastHash = strings.Repeat("0", 64)
+	if problem := verify(forged, key); problem != "the signature doesn't match" {
+		t.Errorf("forged checkpoint: %q", problem)
+	}
+	unsigned := forged
+	unsigned.PublicKey, unsigned.Signature = "", ""
+	if problem := verify(unsigned, key); problem != "the checkpoint isn't signed" {
+		t.Errorf("unsigned checkpoint: %q", problem)
+	}
+	if problem := verify(unsigned, nil); problem != "record 4 has a different hash" {
+		t.Errorf("unsigned checkpoint with another hash and no key: %q", problem)
+	}
+
+	// a forger can sign with a key of their own, but it isn't the configured one
+	otherKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	swapped, _, err := createCheckpoint(db, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problem := verify(swapped, key); problem != "the checkpoint was signed with another key" {
+		t.Errorf("checkpoint signed with another key: %q", problem)
+	}
+	swapped.PublicKey = c.PublicKey
+	if problem := verify(swapped, key); problem != "the signature doesn't match" {
+		t.Errorf("checkpoint signed with another key claiming the configured one: %q", problem)
+	}
+
+	tamper(t, db, "UPDATE audit_log SET reason = 'on time' WHERE audit_id = 2")
+	if problem := verify(c, key); problem != "the ledger is broken at record 2" {
+		t.Errorf("checkpoint over a tampered ledger: %q", problem)
+	}
+}
+
+func TestParseSigningKey(t *testing.T) {
+	for _, seed := range []string{"", "not base64!", base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		_, err := parseSigningKey(seed)
+		if err == nil {
+			t.Errorf("seed %q was accepted", seed)
+		}
+	}
+}
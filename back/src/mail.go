@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+type mailer interface {
+	send(to, subject, body string) error
+}
+
+func newMailer(c mailConfig) mailer {
+	if c.SMTPHost == "" {
+		return stdoutMailer{}
+	}
+	return smtpMailer{c}
+}
+
+// stdoutMailer is used when no SMTP server is configured, e.g. during development
+type stdoutMailer struct{}
+
+func (stdoutMailer) send(to, subject, body string) error {
+	fmt.Println("mail to " + to + ": " + subject + "\n" + body)
+	return nil
+}
+
+type smtpMailer struct {
+	c mailConfig
+}
+
+func (m smtpMailer) send(to, subject, body string) error {
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return stacktrace.NewError("header injection attempt")
+	}
+
+	msg := "From: " + m.c.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.Replace(body, "\n", "\r\n", -1)
+
+	var auth smtp.Auth
+	if m.c.Username != "" {
+		auth = smtp.PlainAuth("", m.c.Username, m.c.Password, m.c.SMTPHost)
+	}
+
+	addr := m.c.SMTPHost + ":" + strconv.Itoa(m.c.SMTPPort)
+	err := smtp.SendMail(addr, auth, m.c.From, []string{to}, []byte(msg))
+	return stacktrace.Propagate(err, "failed to send mail through "+addr)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeSMTP accepts a single message and sends what it received on the channel once the client quits
+type fakeSMTP struct {
+	listener net.Listener
+	received chan smtpSession
+}
+
+type smtpSession struct {
+	from string
+	to   []string
+	data string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{l, make(chan smtpSession, 1)}
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTP) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTP) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	var session smtpSession
+	reply("220 localhost ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250 localhost") // no STARTTLS or AUTH
+		case "MAIL":
+			session.from = strings.TrimPrefix(line, "MAIL FROM:")
+			reply("250 ok")
+		case "RCPT":
+			session.to = append(session.to, strings.TrimPrefix(line, "RCPT TO:"))
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data []string
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data = append(data, line)
+			}
+			session.data = strings.Join(data, "")
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			s.received <- session
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	server := newFakeSMTP(t)
+	defer server.listener.Close()
+
+	m := newMailer(mailConfig{From: "wms@invalid", SMTPHost: "127.0.0.1", SMTPPort: server.port()})
+	err := m.send("someone@invalid", "Confirm your address", "line one\nline two")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := <-server.received
+	if session.from != "<wms@invalid>" {
+		t.Errorf("envelope sender = %q", session.from)
+	}
+	if len(session.to) != 1 || session.to[0] != "<someone@invalid>" {
+		t.Errorf("envelope recipients = %q", session.to)
+	}
+
+	headers := strings.SplitN(session.data, "\r\n\r\n", 2)
+	if len(headers) != 2 {
+		t.Fatalf("no end of headers in %q", session.data)
+	}
+	for _, want := range []string{"From: wms@invalid", "To: someone@invalid", "Subject: Confirm your address",
+		"Content-Type: text/plain; charset=utf-8"} {
+		if !strings.Contains(headers[0]+"\r\n", want+"\r\n") {
+			t.Errorf("headers don't contain %q: %q", want, headers[0])
+		}
+	}
+	if headers[1] != "line one\r\nline two\r\n" {
+		t.Errorf("body = %q", headers[1])
+	}
+}
+
+func TestSMTPMailerHeaderInjection(t *testing.T) {
+	m := smtpMailer{mailConfig{From: "wms@invalid", SMTPHost: "127.0.0.1", SMTPPort: 1}}
+	for _, to := range []string{"someone@invalid\r\nBcc: other@invalid", "someone@invalid\n"} {
+		err := m.send(to, "subject", "body")
+		if err == nil || !strings.Contains(err.Error(), "header injection") {
+			t.Errorf("send to %q: %v", to, err)
+		}
+	}
+	err := m.send("someone@invalid", "subject\r\nBcc: other@invalid", "body")
+	if err == nil || !strings.Contains(err.Error(), "header injection") {
+		t.Errorf("send with subject containing a newline: %v", err)
+	}
+}
+
+func TestNewMailerWithoutHost(t *testing.T) {
+	if _, ok := newMailer(mailConfig{SMTPPort: 25}).(stdoutMailer); !ok {
+		t.Error("mail is sent by SMTP without a host")
+	}
+}
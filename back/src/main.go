@@ -1,7 +1,9 @@
 package main
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"os"
@@ -11,97 +13,168 @@ import (
 
 	"github.com/AndrewBurian/powermux"
 	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/ed25519"
 )
 
 type env struct {
-	db *sql.DB
+	db     *sql.DB
+	conf   config
+	mailer mailer
+	signer ed25519.PrivateKey // nil if no signing key is configured
+	loc    *time.Location     // for users without a time zone, see getUserLocation
 }
 
-func disqualifier(db *sql.DB) {
+// shiftCloser checks every minute, entries still end at the exact time the policy says
+func shiftCloser(db *sql.DB, policy clockOutPolicy, loc *time.Location) {
 	for {
-		now := time.Now()
-		cutoff := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
-		time.Sleep(time.Until(cutoff))
-		disqualify(db)
+		closeForgottenShifts(db, policy, loc)
+		time.Sleep(time.Minute)
+	}
+}
+
+func cleaner(db *sql.DB, c loginConfig) {
+	for {
+		err := cleanSessions(db)
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to clean sessions"))
+		}
+		err = cleanPasswordResets(db)
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to clean password resets"))
+		}
+		err = cleanChallenges(db)
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to clean challenges"))
+		}
+		err = cleanLoginAttempts(db, c.Retention.Duration)
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to clean login attempts"))
+		}
+		time.Sleep(time.Hour)
 	}
 }
 
 func main() {
-	const init = `
-	CREATE TABLE users (
-		uid INTEGER PRIMARY KEY AUTOINCREMENT, -- so that they don't repeat
-		email TEXT,
-		password_hash BLOB,
-		password_salt BLOB,
-		admin INTEGER CHECK(admin IN (0, 1)),
-		UNIQUE(email)
-	);
-
-	CREATE TABLE user_states (
-		uid INTEGER,
-		state TEXT CHECK(state IN ('I', 'O')),
-		since_unix_s, -- see entries.from_unix_s
-		FOREIGN KEY (uid) REFERENCES users(uid),
-		UNIQUE(uid)
-	);
-
-	CREATE TABLE entries (
-		eid INTEGER PRIMARY KEY AUTOINCREMENT, -- so that they don't repeat
-		uid INTEGER,
-		from_unix_s INTEGER, -- "_s" stands for seconds, unlike the JS millisecond unix time
-		to_unix_s INTEGER, -- see above, can be null, signifies disqualifed entry
-		valid INTEGER CHECK(valid IN (0, 1)),
-		FOREIGN KEY (uid) REFERENCES users(uid),
-		CHECK(from_unix_s <= to_unix_s)
-	);
-
-	CREATE TABLE sessions (
-		sid TEXT,
-		uid INTEGER,
-		expires_unix_s INTEGER, -- see entries.from_unix_s
-		FOREIGN KEY (uid) REFERENCES users(uid)
-	);
-
-	CREATE INDEX sessions_id ON sessions (sid);
-	`
-	var db *sql.DB
-	if _, err := os.Stat("./wms2.db"); os.IsNotExist(err) {
-		// the database hasn't been created yet
-		// so we create it...
-		db, err = sql.Open("sqlite3", "./wms2.db?mode=rwc")
+	conf, err := loadConfig("./wms2.json")
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to load config"))
+		return
+	}
+
+	if conf.Secret == "" {
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		conf.Secret = base64.StdEncoding.EncodeToString(secret)
+		fmt.Println("no secret configured, links sent by email will stop working after a restart")
+	}
+
+	err = conf.PasswordHash.validate()
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to load password hash parameters"))
+		return
+	}
+
+	err = conf.ClockOutPolicy.validate()
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to load clock-out policy"))
+		return
+	}
+
+	err = conf.OvertimePolicy.validate()
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to load overtime policy"))
+		return
+	}
+
+	loc := time.Local
+	if conf.TimeZone != "" {
+		loc, err = loadTimeZone(conf.TimeZone)
 		if err != nil {
-			fmt.Println(stacktrace.Propagate(err, "failed to open the database"))
+			fmt.Println(stacktrace.Propagate(err, "failed to load time zone"))
 			return
 		}
-		defer db.Close()
+	}
 
-		// ...and execute the code
-		_, err = db.Exec(init)
+	var signer ed25519.PrivateKey
+	if conf.SigningKey != "" {
+		signer, err = parseSigningKey(conf.SigningKey)
 		if err != nil {
-			fmt.Println(stacktrace.Propagate(err, "failed to execute init SQL"))
+			fmt.Println(stacktrace.Propagate(err, "failed to load signing key"))
 			return
 		}
-	} else {
-		// the database exists so we assume it's initialised
-		db, err = sql.Open("sqlite3", "./wms2.db?mode=rw")
-		if err != nil {
-			fmt.Println(stacktrace.Propagate(err, "failed to open the database"))
+	}
+
+	// transactions take the write lock as soon as they begin, so that audit records are chained
+	// one after the other, and the busy timeout makes the others wait for it instead of failing
+	db, err := sql.Open("sqlite3", "./wms2.db?mode=rwc&_txlock=immediate&_busy_timeout=5000")
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to open the database"))
+		return
+	}
+	defer db.Close()
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			if len(os.Args) > 2 && os.Args[2] == "status" {
+				err = printMigrationStatus(db)
+				if err != nil {
+					fmt.Println(stacktrace.Propagate(err, "failed to print migration status"))
+				}
+				return
+			}
+			applied, err := migrate(db)
+			fmt.Println("applied", applied, "migration(s)")
+			if err != nil {
+				fmt.Println(stacktrace.Propagate(err, "failed to migrate the database"))
+				return
+			}
+			err = printMigrationStatus(db)
+			if err != nil {
+				fmt.Println(stacktrace.Propagate(err, "failed to print migration status"))
+			}
+			return
+		case "verify":
+			intact, err := printLedgerVerification(db, os.Args[2:], signer)
+			if err != nil {
+				fmt.Println(stacktrace.Propagate(err, "failed to verify the ledger"))
+			}
+			if err != nil || !intact {
+				os.Exit(1) // so that it can be run from cron
+			}
+			return
+		case "checkpoint":
+			err = printCheckpoint(db, signer)
+			if err != nil {
+				fmt.Println(stacktrace.Propagate(err, "failed to create a checkpoint"))
+			}
+			return
+		default:
+			fmt.Println("usage: wms2 [migrate [status] | verify [checkpoint.json...] | checkpoint]")
 			return
 		}
-		defer db.Close()
+	}
+
+	applied, err := migrate(db)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to migrate the database"))
+		return
+	}
+	if applied > 0 {
+		fmt.Println("applied", applied, "migration(s)")
 	}
 
 	db.Exec(`PRAGMA foreign_keys = on;`)
 
-	cleanSessions(db)
-	createUser(db, "test@invalid", "hunter2", false)
-	createUser(db, "admin@invalid", "hunter2", true)
+	createUser(db, "test@invalid", "hunter2", []role{roleEmployee}, true, conf.PasswordHash)
+	createUser(db, "admin@invalid", "hunter2", []role{roleEmployee, roleAdmin}, true, conf.PasswordHash)
 
-	go disqualifier(db)
+	go cleaner(db, conf.Login)
+	go shiftCloser(db, conf.ClockOutPolicy, loc)
 
 	mux := powermux.NewServeMux()
-	env := env{db}
+	env := env{db, conf, newMailer(conf.Mail), signer, loc}
 	routes(mux, env)
-	err := http.ListenAndServe(":3000", mux)
+	err = http.ListenAndServe(":3000", mux)
 	fmt.Println(stacktrace.Propagate(err, ""))
 }
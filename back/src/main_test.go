@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestDB opens a migrated database in a temporary directory, with the same options as main
+func newTestDB(t *testing.T) (db *sql.DB, cleanup func()) {
+	dir, err := ioutil.TempDir("", "wms2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = sql.Open("sqlite3", filepath.Join(dir, "wms2.db")+"?mode=rwc&_txlock=immediate&_busy_timeout=5000")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	cleanup = func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+
+	_, err = migrate(db)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	db.Exec(`PRAGMA foreign_keys = on;`)
+
+	return db, cleanup
+}
+
+// newTestUser creates an active user, with cheap password hashing since the tests don't log in
+func newTestUser(t *testing.T, db *sql.DB, email string, roles []role) uidT {
+	t.Helper()
+	params := hashParams{Time: 1, Memory: 1024, Threads: 1, SaltLength: 16, KeyLength: 32}
+	uid, err := createUser(db, email, "hunter2", roles, true, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uid
+}
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+type migration struct {
+	version     int
+	description string
+	up          string
+	upFunc      func(tx *sql.Tx) error // for what can't be done in SQL alone, runs after up
+}
+
+// migrations must only ever be appended to, a migration that has been
+// released can't be changed because it won't be run again on existing databases
+var migrations = []migration{
+	{version: 1, description: "initial schema", up: `
+	CREATE TABLE users (
+		uid INTEGER PRIMARY KEY AUTOINCREMENT, -- so that they don't repeat
+		email TEXT,
+		password_hash BLOB,
+		password_salt BLOB,
+		admin INTEGER CHECK(admin IN (0, 1)),
+		UNIQUE(email)
+	);
+
+	CREATE TABLE user_states (
+		uid INTEGER,
+		state TEXT CHECK(state IN ('I', 'O')),
+		since_unix_s, -- see entries.from_unix_s
+		FOREIGN KEY (uid) REFERENCES users(uid),
+		UNIQUE(uid)
+	);
+
+	CREATE TABLE entries (
+		eid INTEGER PRIMARY KEY AUTOINCREMENT, -- so that they don't repeat
+		uid INTEGER,
+		from_unix_s INTEGER, -- "_s" stands for seconds, unlike the JS millisecond unix time
+		to_unix_s INTEGER, -- see above, can be null, signifies disqualifed entry
+		valid INTEGER CHECK(valid IN (0, 1)),
+		FOREIGN KEY (uid) REFERENCES users(uid),
+		CHECK(from_unix_s <= to_unix_s)
+	);
+
+	CREATE TABLE sessions (
+		sid TEXT,
+		uid INTEGER,
+		expires_unix_s INTEGER, -- see entries.from_unix_s
+		FOREIGN KEY (uid) REFERENCES users(uid)
+	);
+
+	CREATE INDEX sessions_id ON sessions (sid);
+	`},
+	{version: 2, description: "holidays", up: `
+	CREATE TABLE holidays (
+		date TEXT, -- "YYYY-MM-DD", a calendar date doesn't depend on a time zone
+		name TEXT,
+		half INTEGER CHECK(half IN (0, 1)),
+		UNIQUE(date)
+	);
+	`},
+	{version: 3, description: "work schedules", up: `
+	CREATE TABLE schedules (
+		uid INTEGER,
+		effective_from TEXT, -- see holidays.date
+		sunday_s INTEGER, -- expected work time in seconds
+		monday_s INTEGER,
+		tuesday_s INTEGER,
+		wednesday_s INTEGER,
+		thursday_s INTEGER,
+		friday_s INTEGER,
+		saturday_s INTEGER,
+		FOREIGN KEY (uid) REFERENCES users(uid),
+		UNIQUE(uid, effective_from)
+	);
+	`},
+	{version: 4, description: "leave", up: `
+	CREATE TABLE leave_types (
+		code TEXT,
+		name TEXT,
+		paid INTEGER CHECK(paid IN (0, 1)),
+		UNIQUE(code)
+	);
+
+	INSERT INTO leave_types (code, name, paid) VALUES
+		('vacation', 'Vacation', 1),
+		('sick', 'Sick leave', 1),
+		('unpaid', 'Unpaid leave', 0);
+
+	CREATE TABLE leave (
+		lid INTEGER PRIMARY KEY AUTOINCREMENT, -- so that they don't repeat
+		uid INTEGER,
+		type TEXT,
+		from_date TEXT, -- see holidays.date, inclusive
+		to_date TEXT, -- see above, inclusive
+		half INTEGER CHECK(half IN (0, 1)), -- covers half of the expected time of each day
+		reason TEXT,
+		status TEXT CHECK(status IN ('P', 'A', 'R', 'C')), -- pending, approved, rejected, cancelled
+		requested_unix_s INTEGER, -- see entries.from_unix_s
+		decided_by INTEGER, -- null until approved or rejected
+		decided_unix_s INTEGER, -- see above
+		FOREIGN KEY (uid) REFERENCES users(uid),
+		FOREIGN KEY (type) REFERENCES leave_types(code),
+		FOREIGN KEY (decided_by) REFERENCES users(uid),
+		CHECK(from_date <= to_date)
+	);
+
+	CREATE INDEX leave_uid ON leave (uid, from_date);
+	`},
+	{version: 5, description: "deactivating users", up: `
+	ALTER TABLE users ADD COLUMN active INTEGER NOT NULL DEFAULT 1 CHECK(active IN (0, 1));
+	`},
+	{version: 6, description: "password resets", up: `
+	CREATE TABLE password_resets (
+		token_hash TEXT, -- hex SHA-256 of the token, the token itself is only sent by email
+		uid INTEGER,
+		expires_unix_s INTEGER, -- see entries.from_unix_s
+		used INTEGER CHECK(used IN (0, 1)),
+		FOREIGN KEY (uid) REFERENCES users(uid),
+		UNIQUE(token_hash)
+	);
+	`},
+	{version: 7, description: "email confirmation", up: `
+	ALTER TABLE users ADD COLUMN verified INTEGER NOT NULL DEFAULT 1 CHECK(verified IN (0, 1)); -- existing users count as verified
+	ALTER TABLE users ADD COLUMN pending_email TEXT; -- the new address until it's confirmed
+	`},
+	{version: 8, description: "session metadata", up: `
+	CREATE TABLE sessions_new (
+		session_id INTEGER PRIMARY KEY AUTOINCREMENT, -- identifies the session without revealing the token
+		sid TEXT,
+		uid INTEGER,
+		expires_unix_s INTEGER, -- see entries.from_unix_s
+		created_unix_s INTEGER, -- see above, null for sessions created before this migration
+		last_used_unix_s INTEGER, -- see above
+		ip TEXT,
+		user_agent TEXT,
+		FOREIGN KEY (uid) REFERENCES users(uid)
+	);
+
+	INSERT INTO sessions_new (sid, uid, expires_unix_s)
+		SELECT sid, uid, expires_unix_s FROM sessions;
+	DROP TABLE sessions;
+	ALTER TABLE sessions_new RENAME TO sessions;
+
+	CREATE INDEX sessions_id ON sessions (sid);
+	`},
+	{version: 9, description: "hashed session tokens", upFunc: hashSessionTokens},
+	{version: 10, description: "login throttling", up: `
+	CREATE TABLE login_attempts (
+		attempt_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT, -- as typed in
+		uid INTEGER, -- null if the email doesn't belong to anyone
+		ip TEXT,
+		success INTEGER CHECK(success IN (0, 1)),
+		at_unix_s INTEGER, -- see entries.from_unix_s
+		FOREIGN KEY (uid) REFERENCES users(uid)
+	);
+
+	CREATE INDEX login_attempts_at ON login_attempts (at_unix_s);
+
+	CREATE TABLE login_throttles (
+		kind TEXT CHECK(kind IN ('U', 'I')), -- per user or per client IP
+		key TEXT, -- uid or IP
+		failures INTEGER, -- in a row
+		last_failure_unix_s INTEGER, -- see entries.from_unix_s
+		blocked_until_unix_s INTEGER, -- see above
+		UNIQUE(kind, key)
+	);
+	`},
+	{version: 11, description: "self-describing password hashes", upFunc: encodeLegacyHashes},
+	{version: 12, description: "two-factor authentication", up: `
+	ALTER TABLE users ADD COLUMN totp_secret TEXT; -- base32, set when enrollment begins
+	ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0 CHECK(totp_enabled IN (0, 1)); -- set once a code was confirmed
+	ALTER TABLE users ADD COLUMN totp_required INTEGER NOT NULL DEFAULT 0 CHECK(totp_required IN (0, 1));
+	ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0; -- codes from this step or earlier can't be reused
+
+	CREATE TABLE recovery_codes (
+		uid INTEGER,
+		code_hash TEXT, -- see password_resets.token_hash
+		used INTEGER CHECK(used IN (0, 1)),
+		FOREIGN KEY (uid) REFERENCES users(uid),
+		UNIQUE(uid, code_hash)
+	);
+
+	CREATE TABLE auth_challenges (
+		challenge_hash TEXT, -- see password_resets.token_hash
+		uid INTEGER,
+		expires_unix_s INTEGER, -- see entries.from_unix_s
+		FOREIGN KEY (uid) REFERENCES users(uid),
+		UNIQUE(challenge_hash)
+	);
+	`},
+	{version: 13, description: "API keys", up: `
+	CREATE TABLE api_keys (
+		key_id INTEGER PRIMARY KEY,
+		uid INTEGER,
+		name TEXT,
+		key_hash TEXT, -- see password_resets.token_hash
+		scope TEXT CHECK(scope IN ('clock', 'read', 'admin')),
+		created_unix_s INTEGER, -- see entries.from_unix_s
+		last_used_unix_s INTEGER, -- NULL if never used
+		FOREIGN KEY (uid) REFERENCES users(uid),
+		UNIQUE(key_hash)
+	);
+	`},
+	{version: 14, description: "roles", up: `
+	CREATE TABLE user_roles (
+		uid INTEGER,
+		role TEXT CHECK(role IN ('employee', 'manager', 'hr', 'payroll', 'auditor', 'admin')),
+		FOREIGN KEY (uid) REFERENCES users(uid),
+		UNIQUE(uid, role)
+	);
+
+	-- users.admin is no longer used
+	INSERT INTO user_roles (uid, role) SELECT uid, 'employee' FROM users;
+	INSERT INTO user_roles (uid, role) SELECT uid, 'admin' FROM users WHERE admin = 1;
+
+	CREATE TABLE teams (
+		team_id INTEGER PRIMARY KEY,
+		name TEXT
+	);
+
+	CREATE TABLE team_members (
+		team_id INTEGER,
+		uid INTEGER,
+		manager INTEGER CHECK(manager IN (0, 1)),
+		FOREIGN KEY (team_id) REFERENCES teams(team_id),
+		FOREIGN KEY (uid) REFERENCES users(uid),
+		UNIQUE(team_id, uid)
+	);
+
+	-- who the permissions of managers apply to
+	CREATE VIEW managed_users AS
+		SELECT managers.uid AS manager_uid, members.uid AS uid
+		FROM team_members managers JOIN team_members members ON managers.team_id = members.team_id
+		WHERE managers.manager = 1 AND members.uid != managers.uid;
+	`},
+	{version: 15, description: "nested teams", up: `
+	ALTER TABLE teams ADD COLUMN parent_id INTEGER REFERENCES teams(team_id); -- NULL for top level teams
+
+	CREATE VIEW team_descendants AS
+		WITH RECURSIVE tree(ancestor_id, team_id) AS (
+			SELECT team_id, team_id FROM teams
+			UNION
+			SELECT tree.ancestor_id, teams.team_id FROM tree JOIN teams ON teams.parent_id = tree.team_id
+		)
+		SELECT ancestor_id, team_id FROM tree;
+
+	-- managers also manage everyone in the teams below theirs
+	DROP VIEW managed_users;
+	CREATE VIEW managed_users AS
+		SELECT DISTINCT managers.uid AS manager_uid, members.uid AS uid
+		FROM team_members managers
+		JOIN team_descendants ON team_descendants.ancestor_id = managers.team_id
+		JOIN team_members members ON members.team_id = team_descendants.team_id
+		WHERE managers.manager = 1 AND members.uid != managers.uid;
+	`},
+	{version: 16, description: "audit log", up: `
+	CREATE TABLE audit_log (
+		audit_id INTEGER PRIMARY KEY,
+		at_unix_s INTEGER, -- see entries.from_unix_s
+		actor_uid INTEGER, -- 0 for changes made by wms2 itself
+		action TEXT,
+		uid INTEGER, -- whose data was changed
+		target TEXT, -- e.g. entry:12
+		before_json TEXT, -- NULL for anything that was created
+		after_json TEXT, -- NULL for anything that was deleted
+		reason TEXT
+	);
+	CREATE INDEX audit_log_uid ON audit_log(uid, at_unix_s);
+
+	CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'the audit log is append-only');
+	END;
+	CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'the audit log is append-only');
+	END;
+	`},
+	{version: 17, description: "hash-chained audit log", up: `
+	DROP TRIGGER audit_log_no_update; -- recreated by chainAuditLog once the hashes are filled in
+	ALTER TABLE audit_log ADD COLUMN prev_hash TEXT; -- see auditHash
+	ALTER TABLE audit_log ADD COLUMN hash TEXT;
+	`, upFunc: chainAuditLog},
+	{version: 18, description: "correction requests", up: `
+	CREATE TABLE corrections (
+		cid INTEGER PRIMARY KEY AUTOINCREMENT, -- see leave.lid
+		uid INTEGER,
+		kind TEXT CHECK(kind IN ('A', 'E', 'V')), -- add a missing entry, edit one or revalidate a disqualified one
+		eid INTEGER, -- null when adding until approved, then the added entry
+		from_unix_s INTEGER, -- see entries.from_unix_s, null when revalidating
+		to_unix_s INTEGER, -- see above
+		reason TEXT,
+		status TEXT CHECK(status IN ('P', 'A', 'R', 'C')), -- see leave.status
+		requested_unix_s INTEGER, -- see entries.from_unix_s
+		decided_by INTEGER, -- see leave.decided_by
+		decided_unix_s INTEGER, -- see above
+		FOREIGN KEY (uid) REFERENCES users(uid),
+		FOREIGN KEY (decided_by) REFERENCES users(uid),
+		CHECK(from_unix_s <= to_unix_s)
+	);
+	CREATE INDEX corrections_status ON corrections(status, uid);
+	`},
+	{version: 19, description: "clock-out policies", up: `
+	ALTER TABLE entries ADD COLUMN auto_policy TEXT; -- see clockOutPolicy.Kind, null unless the shift was closed by one
+	ALTER TABLE entries ADD COLUMN auto_reason TEXT; -- see above
+	ALTER TABLE teams ADD COLUMN clock_out_policy TEXT; -- JSON, null to inherit it from the team above
+	`},
+	{version: 20, description: "shifts across midnight", up: `
+	-- count shifts towards the day they start on instead of splitting them at midnight, null to inherit
+	ALTER TABLE teams ADD COLUMN whole_shifts INTEGER CHECK(whole_shifts IN (0, 1));
+	`},
+	{version: 21, description: "time zones", up: `
+	ALTER TABLE users ADD COLUMN time_zone TEXT; -- like Europe/Vienna, null to inherit it from the user's teams
+	ALTER TABLE teams ADD COLUMN time_zone TEXT; -- null to inherit it from the team above
+	`},
+	{version: 22, description: "entries index", up: `
+	CREATE INDEX entries_uid ON entries(uid, from_unix_s);
+	`},
+	{version: 23, description: "balances", up: `
+	ALTER TABLE users ADD COLUMN start_date TEXT; -- see dateLayout, null for the day of the user's first entry
+	ALTER TABLE users ADD COLUMN opening_balance_s INTEGER NOT NULL DEFAULT 0; -- the user's balance at the start of it
+	`},
+	{version: 24, description: "overtime ledger", up: `
+	CREATE TABLE overtime_adjustments (
+		adjustment_id INTEGER PRIMARY KEY AUTOINCREMENT, -- so that they don't repeat
+		uid INTEGER,
+		kind TEXT CHECK(kind IN ('payout', 'writeOff', 'correction', 'opening')),
+		date TEXT, -- see dateLayout, in the user's time zone
+		seconds INTEGER, -- added to the balance, negative for payouts and write-offs
+		reason TEXT,
+		created_by INTEGER, -- null for opening balances carried over from users.opening_balance_s
+		created_unix_s INTEGER, -- see entries.from_unix_s
+		FOREIGN KEY (uid) REFERENCES users(uid),
+		FOREIGN KEY (created_by) REFERENCES users(uid)
+	);
+	CREATE INDEX overtime_adjustments_uid ON overtime_adjustments(uid, date);
+
+	-- opening balances are adjustments from now on, the column stays at 0
+	INSERT INTO overtime_adjustments (uid, kind, date, seconds, reason, created_unix_s)
+		SELECT uid, 'opening', COALESCE(start_date, date('now')), opening_balance_s, 'opening balance', strftime('%s', 'now')
+		FROM users WHERE opening_balance_s != 0;
+	UPDATE users SET opening_balance_s = 0;
+
+	ALTER TABLE teams ADD COLUMN overtime_policy TEXT; -- JSON, null to inherit it from the team above
+	`},
+	{version: 25, description: "balance closings", up: `
+	-- where the walk through each user's balance was at the start of a month, so that it can be picked up there
+	CREATE TABLE balance_closings (
+		uid INTEGER PRIMARY KEY,
+		month TEXT, -- see dateLayout, the first day of the month
+		audit_id INTEGER, -- the last audit record that could have changed it when it was made, see lastBalanceAuditID
+		stamp TEXT, -- see closingStamp
+		balance_s INTEGER,
+		surpluses_json TEXT, -- see storedSurplus, oldest first
+		FOREIGN KEY (uid) REFERENCES users(uid)
+	);
+	`},
+	{version: 26, description: "login throttles per email address", up: `
+	CREATE TABLE login_throttles_new (
+		kind TEXT CHECK(kind IN ('U', 'I', 'E')), -- per user, per client IP or per email address logged in with
+		key TEXT, -- uid, IP or email address
+		failures INTEGER, -- in a row
+		last_failure_unix_s INTEGER, -- see entries.from_unix_s
+		blocked_until_unix_s INTEGER, -- see above
+		UNIQUE(kind, key)
+	);
+
+	INSERT INTO login_throttles_new SELECT kind, key, failures, last_failure_unix_s, blocked_until_unix_s FROM login_throttles;
+	DROP TABLE login_throttles;
+	ALTER TABLE login_throttles_new RENAME TO login_throttles;
+	`},
+	{version: 27, description: "corrected entries as they were requested for", up: `
+	-- approving a correction fails if the entry changed since, null when adding
+	ALTER TABLE corrections ADD COLUMN entry_from_unix_s INTEGER;
+	ALTER TABLE corrections ADD COLUMN entry_to_unix_s INTEGER; -- see above
+	ALTER TABLE corrections ADD COLUMN entry_valid INTEGER; -- see above
+
+	-- pending corrections are held against the entries as they are now, revalidations
+	-- take the end the entry gets from now on and keep the one it has
+	UPDATE corrections SET
+		entry_from_unix_s = (SELECT from_unix_s FROM entries WHERE eid = corrections.eid),
+		entry_to_unix_s = (SELECT to_unix_s FROM entries WHERE eid = corrections.eid),
+		entry_valid = (SELECT valid FROM entries WHERE eid = corrections.eid)
+		WHERE status = 'P' AND kind IN ('E', 'V');
+	UPDATE corrections SET to_unix_s = entry_to_unix_s WHERE status = 'P' AND kind = 'V';
+	`},
+}
+
+// chainAuditLog hashes the records made so far and adds one for every entry made before
+// the audit log existed, so that the ledger can vouch for all of them from now on
+func chainAuditLog(tx *sql.Tx) (err error) {
+	rows, err := tx.Query("SELECT " + auditColumns + " FROM audit_log ORDER BY audit_id")
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to list audit records")
+	}
+
+	var records []auditRecord
+	for rows.Next() {
+		a, err := scanAuditRecord(rows)
+		if err != nil {
+			rows.Close()
+			return stacktrace.Propagate(err, "")
+		}
+		records = append(records, a)
+	}
+	rows.Close()
+
+	prev := ""
+	for _, a := range records {
+		a.Prev = prev
+		a.Hash = auditHash(a)
+		_, err = tx.Exec("UPDATE audit_log SET prev_hash = ?1, hash = ?2 WHERE audit_id = ?3", a.Prev, a.Hash, a.ID)
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to hash audit record")
+		}
+		prev = a.Hash
+	}
+
+	rows, err = tx.Query(
+		`SELECT uid, eid, from_unix_s, to_unix_s, valid FROM entries
+			WHERE 'entry:' || eid NOT IN (SELECT target FROM audit_log) ORDER BY eid`)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to list unrecorded entries")
+	}
+
+	uids := make(map[eidT]uidT)
+	var unrecorded []entry
+	for rows.Next() {
+		var uid uidT
+		var e entry
+		err = rows.Scan(&uid, &e.EID, &e.From, &e.To, &e.Valid)
+		if err != nil {
+			rows.Close()
+			return stacktrace.Propagate(err, "failed to scan row")
+		}
+		uids[e.EID] = uid
+		unrecorded = append(unrecorded, e)
+	}
+	rows.Close()
+
+	for _, e := range unrecorded {
+		err = recordAudit(tx, systemActor, auditEntryImport, uids[e.EID], entryTarget(e.EID), nil, e, "made before the audit log existed")
+		if err != nil {
+			return stacktrace.Propagate(err, "")
+		}
+	}
+
+	_, err = tx.Exec(`
+	CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'the audit log is append-only');
+	END;`)
+	return stacktrace.Propagate(err, "failed to recreate trigger")
+}
+
+// encodeLegacyHashes moves the salt into password_hash, which
+// from now on holds hashes in the format produced by encodeHash
+func encodeLegacyHashes(tx *sql.Tx) (err error) {
+	rows, err := tx.Query("SELECT uid, password_hash, password_salt FROM users WHERE password_salt IS NOT NULL")
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to list users")
+	}
+
+	hashes := make(map[uidT]string)
+	for rows.Next() {
+		var uid uidT
+		var key, salt []byte
+		err = rows.Scan(&uid, &key, &salt)
+		if err != nil {
+			rows.Close()
+			return stacktrace.Propagate(err, "failed to scan row")
+		}
+		hashes[uid] = encodeHash(legacyHashParams, salt, key)
+	}
+	rows.Close()
+
+	for uid, hash := range hashes {
+		_, err = tx.Exec("UPDATE users SET password_hash = ?1, password_salt = NULL WHERE uid = ?2", hash, uid)
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to encode hash")
+		}
+	}
+	return nil
+}
+
+func hashSessionTokens(tx *sql.Tx) (err error) {
+	rows, err := tx.Query("SELECT session_id, sid FROM sessions")
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to list sessions")
+	}
+
+	hashes := make(map[sessionIDT]string)
+	for rows.Next() {
+		var id sessionIDT
+		var sid sidT
+		err = rows.Scan(&id, &sid)
+		if err != nil {
+			rows.Close()
+			return stacktrace.Propagate(err, "failed to scan row")
+		}
+		hashes[id] = hashToken(string(sid))
+	}
+	rows.Close()
+
+	for id, hash := range hashes {
+		_, err = tx.Exec("UPDATE sessions SET sid = ?1 WHERE session_id = ?2", hash, id)
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to hash session token")
+		}
+	}
+	return nil
+}
+
+type migrationStatus struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	Applied     bool   `json:"applied"`
+	AppliedAt   int    `json:"appliedAt"`
+}
+
+func prepareMigrations(db *sql.DB) (err error) {
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		description TEXT,
+		applied_unix_s INTEGER -- see entries.from_unix_s
+	)`)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to create the schema_migrations table")
+	}
+
+	var applied int
+	err = db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to count applied migrations")
+	}
+	if applied > 0 {
+		return nil
+	}
+
+	// databases created before migrations existed already have the initial schema
+	// but nothing recording it, so we mark it as applied instead of running it again
+	err = db.QueryRow("SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'users'").Scan(new(int))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to check for a pre-migration schema")
+	}
+
+	_, err = db.Exec(
+		`INSERT INTO schema_migrations (version, description, applied_unix_s)
+			VALUES (?1, ?2, ?3)`, migrations[0].version, migrations[0].description, time.Now().Unix())
+	return stacktrace.Propagate(err, "failed to record the pre-migration schema")
+}
+
+func applyMigration(db *sql.DB, m migration) (err error) {
+	tx, err := db.Begin()
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to begin transaction")
+	}
+
+	if m.up != "" {
+		_, err = tx.Exec(m.up)
+		if err != nil {
+			rollback()
+			return stacktrace.Propagate(err, "failed to execute migration SQL")
+		}
+	}
+
+	if m.upFunc != nil {
+		err = m.upFunc(tx)
+		if err != nil {
+			rollback()
+			return stacktrace.Propagate(err, "failed to execute migration function")
+		}
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO schema_migrations (version, description, applied_unix_s)
+			VALUES (?1, ?2, ?3)`, m.version, m.description, time.Now().Unix())
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "failed to record migration")
+	}
+
+	return stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+func migrate(db *sql.DB) (applied int, err error) {
+	err = prepareMigrations(db)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to prepare migrations")
+	}
+
+	statuses, err := getMigrationStatus(db)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to get migration status")
+	}
+
+	for i, m := range migrations {
+		if statuses[i].Applied {
+			continue
+		}
+		err = applyMigration(db, m)
+		if err != nil {
+			return applied, stacktrace.Propagate(err, "failed to apply migration "+strconv.Itoa(m.version))
+		}
+		applied++
+	}
+
+	return applied, nil
+}
+
+func getMigrationStatus(db *sql.DB) (statuses []migrationStatus, err error) {
+	err = prepareMigrations(db)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to prepare migrations")
+	}
+
+	rows, err := db.Query("SELECT version, applied_unix_s FROM schema_migrations")
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list applied migrations")
+	}
+	defer rows.Close()
+
+	appliedAt := make(map[int]int)
+	for rows.Next() {
+		var version, at int
+		err = rows.Scan(&version, &at)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		appliedAt[version] = at
+	}
+
+	for _, m := range migrations {
+		at, ok := appliedAt[m.version]
+		statuses = append(statuses, migrationStatus{m.version, m.description, ok, at})
+	}
+
+	return statuses, nil
+}
+
+func printMigrationStatus(db *sql.DB) (err error) {
+	statuses, err := getMigrationStatus(db)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get migration status")
+	}
+
+	for _, s := range statuses {
+		if s.Applied {
+			fmt.Printf("%4d  applied %s  %s\n", s.Version, time.Unix(int64(s.AppliedAt), 0).Format(time.RFC3339), s.Description)
+		} else {
+			fmt.Printf("%4d  pending %-25s  %s\n", s.Version, "", s.Description)
+		}
+	}
+	return nil
+}
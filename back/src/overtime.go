@@ -0,0 +1,406 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+type adjustmentIDT int
+
+// kinds of transactions in the overtime ledger, only adjustments are stored, see the overtime_adjustments table
+const (
+	overtimePayout     = "payout"     // taken off the balance and paid
+	overtimeWriteOff   = "writeOff"   // taken off the balance without paying
+	overtimeCorrection = "correction" // either way
+	overtimeOpening    = "opening"    // the balance the user had before they started using this
+	overtimeTime       = "time"       // what was worked minus what was expected in a month
+	overtimeCap        = "cap"        // surplus above the cap, forfeited at the end of a month
+	overtimeExpiry     = "expiry"     // surplus that wasn't used in time
+)
+
+type adjustment struct {
+	ID        adjustmentIDT `json:"id"` // 0 for transactions that aren't stored
+	Date      string        `json:"date"`
+	Kind      string        `json:"kind"`
+	Seconds   int           `json:"seconds"`
+	Reason    string        `json:"reason"`
+	CreatedBy uidT          `json:"createdBy"` // 0 if nobody made it
+	CreatedAt int           `json:"createdAt"` // see above
+	Balance   int           `json:"balance"`   // the running total after it
+}
+
+type overtimePolicy struct {
+	Cap          int `json:"cap"`          // seconds the balance is cut down to at the end of each month, 0 for no cap
+	ExpiryMonths int `json:"expiryMonths"` // surplus expires this many months after the one it was worked in, 0 for never
+}
+
+var errInvalidOvertimePolicy = errors.New("invalid overtime policy")
+
+func (p overtimePolicy) validate() (err error) {
+	if p.Cap < 0 {
+		return stacktrace.Propagate(errInvalidOvertimePolicy, "negative cap")
+	}
+	if p.ExpiryMonths < 0 || p.ExpiryMonths > 120 {
+		return stacktrace.Propagate(errInvalidOvertimePolicy, "expiry out of range")
+	}
+	return nil
+}
+
+func adjustmentTarget(id adjustmentIDT) string {
+	return "overtime:" + strconv.Itoa(int(id))
+}
+
+// addAdjustment takes seconds as they're added to the balance
+func addAdjustment(db *sql.DB, uid uidT, a adjustment) (id adjustmentIDT, err error) {
+	tx, err := db.Begin()
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+	if err != nil {
+		return -1, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+
+	res, err := tx.Exec(
+		`INSERT INTO overtime_adjustments (uid, kind, date, seconds, reason, created_by, created_unix_s)
+			VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7)`, uid, a.Kind, a.Date, a.Seconds, a.Reason, a.CreatedBy, a.CreatedAt)
+	if err != nil {
+		rollback()
+		return -1, stacktrace.Propagate(err, "failed to insert a row into the overtime_adjustments table")
+	}
+
+	intID, err := res.LastInsertId()
+	if err != nil {
+		rollback()
+		return -1, stacktrace.Propagate(err, "failed to get adjustment id")
+	}
+	a.ID = adjustmentIDT(intID)
+
+	err = recordAudit(tx, a.CreatedBy, auditOvertimeAdjust, uid, adjustmentTarget(a.ID), nil,
+		map[string]interface{}{"kind": a.Kind, "date": a.Date, "seconds": a.Seconds}, a.Reason)
+	if err != nil {
+		rollback()
+		return -1, stacktrace.Propagate(err, "")
+	}
+
+	return a.ID, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// listAdjustments lists the user's adjustments from and to the dates, both inclusive, in the order they apply in.
+// from can be empty to list them from the first one
+func listAdjustments(db *sql.DB, uid uidT, from, to string) (adjustments []adjustment, err error) {
+	rows, err := db.Query(
+		`SELECT adjustment_id, date, kind, seconds, reason, COALESCE(created_by, 0), created_unix_s
+			FROM overtime_adjustments WHERE uid = ?1 AND date >= ?2 AND date <= ?3 ORDER BY date, adjustment_id`,
+		uid, from, to)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list adjustments")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a adjustment
+		err = rows.Scan(&a.ID, &a.Date, &a.Kind, &a.Seconds, &a.Reason, &a.CreatedBy, &a.CreatedAt)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		adjustments = append(adjustments, a)
+	}
+
+	return adjustments, nil
+}
+
+// getTeamOvertimePolicy returns nil if the team inherits its policy
+func getTeamOvertimePolicy(db execer, id teamIDT) (p *overtimePolicy, err error) {
+	var js sql.NullString
+	err = db.QueryRow("SELECT overtime_policy FROM teams WHERE team_id = ?", id).Scan(&js)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to get overtime policy")
+	}
+	if !js.Valid {
+		return nil, nil
+	}
+
+	p = &overtimePolicy{}
+	err = json.Unmarshal([]byte(js.String), p)
+	return p, stacktrace.Propagate(err, "malformed overtime policy")
+}
+
+// setTeamOvertimePolicy makes the team inherit its policy again if p is nil
+func setTeamOvertimePolicy(db execer, id teamIDT, p *overtimePolicy) (err error) {
+	var js interface{}
+	if p != nil {
+		raw, _ := json.Marshal(p)
+		js = string(raw)
+	}
+
+	_, err = db.Exec("UPDATE teams SET overtime_policy = ?1 WHERE team_id = ?2", js, id)
+	return stacktrace.Propagate(err, "failed to set overtime policy")
+}
+
+// getUserOvertimePolicy works like getUserPolicy
+func getUserOvertimePolicy(db *sql.DB, uid uidT, fallback overtimePolicy) (p overtimePolicy, err error) {
+	js, err := getUserTeamSetting(db, uid, "overtime_policy")
+	if err != nil {
+		return p, stacktrace.Propagate(err, "")
+	}
+	if !js.Valid {
+		return fallback, nil
+	}
+
+	err = json.Unmarshal([]byte(js.String), &p)
+	return p, stacktrace.Propagate(err, "malformed overtime policy")
+}
+
+// balanceDay is a day of the user's balance, adjusted includes the transactions that aren't stored
+type balanceDay struct {
+	date                       time.Time
+	worked, expected, adjusted int
+	balance                    int // at the end of the day
+}
+
+// surplus is the positive part of the balance that was added in a month, it's used up oldest first
+type surplus struct {
+	month   time.Time
+	seconds int
+}
+
+// balanceClosing is where the walk through a user's balance is at the start of a month, see walkOvertime
+type balanceClosing struct {
+	month     time.Time
+	balance   int
+	surpluses []surplus
+}
+
+// getOvertime walks the user's balance up to and including the date to, from the start date or the first adjustment,
+// whichever is earlier, in the location of to. Besides the days, it returns the ledger, which has the stored adjustments,
+// a time transaction for each month, and where the month is over, the transactions that the user's policy makes
+func getOvertime(db *sql.DB, uid uidT, to time.Time, fallback overtimePolicy) (days []balanceDay, ledger []adjustment, err error) {
+	policy, err := getUserOvertimePolicy(db, uid, fallback)
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "")
+	}
+
+	days, ledger, _, err = walkOvertime(db, uid, to, policy, nil)
+	return days, ledger, stacktrace.Propagate(err, "")
+}
+
+// walkOvertime does the walk for getOvertime. If from isn't nil, the walk is picked up there instead, and the days and
+// the ledger start there too. It also returns where the walk was at the start of the month of to if that has started,
+// otherwise, or if the walk started later, the closing's month is zero
+func walkOvertime(db *sql.DB, uid uidT, to time.Time, policy overtimePolicy, from *balanceClosing) (days []balanceDay,
+	ledger []adjustment, closing balanceClosing, err error) {
+	loc := to.Location()
+	start, err := getBalanceStart(db, uid, loc)
+	if err != nil {
+		return nil, nil, closing, stacktrace.Propagate(err, "")
+	}
+
+	since := ""
+	if from != nil {
+		since = from.month.Format(dateLayout)
+	}
+	adjustments, err := listAdjustments(db, uid, since, to.Format(dateLayout))
+	if err != nil {
+		return nil, nil, closing, stacktrace.Propagate(err, "")
+	}
+	first := start
+	if from != nil {
+		first = from.month
+	} else if len(adjustments) > 0 {
+		date, err := time.ParseInLocation(dateLayout, adjustments[0].Date, loc)
+		if err != nil {
+			return nil, nil, closing, stacktrace.Propagate(err, "malformed date")
+		}
+		if date.Before(first) {
+			first = date
+		}
+	}
+
+	// days before the start don't count, and neither do those before the walk is picked up
+	counted := start
+	if first.After(counted) {
+		counted = first
+	}
+	end := nextMidnight(to)
+	worked, err := getWorkedByDay(db, uid, counted, end)
+	if err != nil {
+		return nil, nil, closing, stacktrace.Propagate(err, "")
+	}
+	expected, err := loadExpectedTime(db, uid, counted, to)
+	if err != nil {
+		return nil, nil, closing, stacktrace.Propagate(err, "failed to get expected time")
+	}
+
+	balance, ledgerBalance, monthTime := 0, 0, 0
+	var surpluses []surplus
+	if from != nil {
+		balance, ledgerBalance = from.balance, from.balance
+		surpluses = append([]surplus(nil), from.surpluses...) // take changes them in place
+	}
+	record := func(a adjustment) {
+		ledgerBalance += a.Seconds
+		a.Balance = ledgerBalance
+		ledger = append(ledger, a)
+	}
+	// take moves the balance by change, keeping track of where the surplus comes from
+	take := func(change int, month time.Time) {
+		before := balance
+		balance += change
+		if before < 0 {
+			before = 0
+		}
+		after := balance
+		if after < 0 {
+			after = 0
+		}
+
+		if after > before {
+			if len(surpluses) > 0 && surpluses[len(surpluses)-1].month.Equal(month) {
+				surpluses[len(surpluses)-1].seconds += after - before
+			} else {
+				surpluses = append(surpluses, surplus{month, after - before})
+			}
+		}
+		for used := before - after; used > 0 && len(surpluses) > 0; {
+			if surpluses[0].seconds > used {
+				surpluses[0].seconds -= used
+				break
+			}
+			used -= surpluses[0].seconds
+			surpluses = surpluses[1:]
+		}
+	}
+
+	closingMonth := reportPeriods["month"](to)
+	for day := first; day.Before(end); day = day.AddDate(0, 0, 1) { // not 24 hours, see getDeltaForMonth
+		d := balanceDay{date: day, worked: worked[day.Unix()]}
+		month := reportPeriods["month"](day)
+		if day.Equal(closingMonth) && !day.After(time.Now()) {
+			closing = balanceClosing{day, balance, append([]surplus(nil), surpluses...)}
+		}
+		date := day.Format(dateLayout)
+
+		for len(adjustments) > 0 && adjustments[0].Date == date {
+			record(adjustments[0])
+			take(adjustments[0].Seconds, month)
+			d.adjusted += adjustments[0].Seconds
+			adjustments = adjustments[1:]
+		}
+
+		if !day.Before(start) {
+			d.expected = expected.forDay(day)
+			take(d.worked-d.expected, month)
+			monthTime += d.worked - d.expected
+		}
+
+		next := day.AddDate(0, 0, 1)
+		if next.Month() != day.Month() || !next.Before(end) {
+			if !day.Before(start) {
+				record(adjustment{Date: date, Kind: overtimeTime, Seconds: monthTime})
+			}
+			monthTime = 0
+		}
+
+		// the policy applies once the month is over
+		if next.Month() != day.Month() && !next.After(time.Now()) {
+			if policy.ExpiryMonths > 0 {
+				for len(surpluses) > 0 && !surpluses[0].month.AddDate(0, policy.ExpiryMonths+1, 0).After(next) {
+					expired := surpluses[0]
+					surpluses = surpluses[1:]
+					balance -= expired.seconds
+					d.adjusted -= expired.seconds
+					record(adjustment{Date: date, Kind: overtimeExpiry, Seconds: -expired.seconds,
+						Reason: "surplus from " + expired.month.Format("2006-01") + " expired"})
+				}
+			}
+			if policy.Cap > 0 && balance > policy.Cap {
+				excess := balance - policy.Cap
+				take(-excess, month)
+				d.adjusted -= excess
+				record(adjustment{Date: date, Kind: overtimeCap, Seconds: -excess,
+					Reason: "capped at " + (time.Duration(policy.Cap) * time.Second).String()})
+			}
+		}
+
+		d.balance = balance
+		days = append(days, d)
+	}
+
+	return days, ledger, closing, nil
+}
+
+// storedSurplus is how surpluses are stored in balance_closings.surpluses_json
+type storedSurplus struct {
+	Month   string `json:"month"` // see dateLayout
+	Seconds int    `json:"seconds"`
+}
+
+// closingStamp tells apart closings made in different locations or under different policies
+func closingStamp(loc *time.Location, policy overtimePolicy) string {
+	js, _ := json.Marshal(policy)
+	return loc.String() + " " + string(js)
+}
+
+// lastBalanceAuditID returns the last audit record that can have changed the user's balance, which is any record of
+// the user's or of everyone's data, e.g. holidays and team settings. Every change to what the balance is walked from
+// is audited, so a closing made after the record is still good
+func lastBalanceAuditID(db *sql.DB, uid uidT) (id int, err error) {
+	err = db.QueryRow("SELECT COALESCE(MAX(audit_id), 0) FROM audit_log WHERE uid IN (?1, 0)", uid).Scan(&id)
+	return id, stacktrace.Propagate(err, "failed to get last audit record")
+}
+
+// getBalanceClosing returns nil if the user has no closing that was made after the audit record with the stamp
+func getBalanceClosing(db *sql.DB, uid uidT, auditID int, stamp string, loc *time.Location) (c *balanceClosing, err error) {
+	var month, js string
+	c = &balanceClosing{}
+	err = db.QueryRow(
+		"SELECT month, balance_s, surpluses_json FROM balance_closings WHERE uid = ?1 AND audit_id = ?2 AND stamp = ?3",
+		uid, auditID, stamp).Scan(&month, &c.balance, &js)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to get balance closing")
+	}
+
+	c.month, err = time.ParseInLocation(dateLayout, month, loc)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "malformed month")
+	}
+	var stored []storedSurplus
+	err = json.Unmarshal([]byte(js), &stored)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "malformed surpluses")
+	}
+	for _, s := range stored {
+		month, err := time.ParseInLocation(dateLayout, s.Month, loc)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "malformed month")
+		}
+		c.surpluses = append(c.surpluses, surplus{month, s.Seconds})
+	}
+	return c, nil
+}
+
+// setBalanceClosing replaces the user's closing
+func setBalanceClosing(db *sql.DB, uid uidT, auditID int, stamp string, c balanceClosing) (err error) {
+	stored := make([]storedSurplus, 0) // doesn't marshal to null
+	for _, s := range c.surpluses {
+		stored = append(stored, storedSurplus{s.month.Format(dateLayout), s.seconds})
+	}
+	js, _ := json.Marshal(stored)
+
+	_, err = db.Exec(
+		`INSERT OR REPLACE INTO balance_closings (uid, month, audit_id, stamp, balance_s, surpluses_json)
+			VALUES (?1, ?2, ?3, ?4, ?5, ?6)`, uid, c.month.Format(dateLayout), auditID, stamp, c.balance, string(js))
+	return stacktrace.Propagate(err, "failed to set balance closing")
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestOvertime makes a user who started on 2025-10-01 and isn't expected to work, so that only adjustments
+// move their balance
+func newTestOvertime(t *testing.T) (db *sql.DB, uid uidT, cleanup func()) {
+	db, cleanup = newTestDB(t)
+
+	uid = newTestUser(t, db, "test@invalid", []role{roleEmployee})
+	err := setSchedule(db, uid, schedule{"2025-01-01", [7]int{}})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	err = setUserBalanceStart(db, uid, "2025-10-01")
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return db, uid, cleanup
+}
+
+func TestOvertimeSurplus(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      overtimePolicy
+		adjustments []adjustment
+		to          string
+		want        []adjustment // the transactions the policy makes
+		balance     int          // hours
+	}{
+		{"payouts use up the oldest surplus first", overtimePolicy{ExpiryMonths: 1},
+			[]adjustment{
+				{Date: "2025-10-05", Kind: overtimeCorrection, Seconds: 10 * 3600},
+				{Date: "2025-11-05", Kind: overtimeCorrection, Seconds: 5 * 3600},
+				{Date: "2025-11-20", Kind: overtimePayout, Seconds: -12 * 3600},
+			}, "2026-01-15",
+			[]adjustment{{Date: "2025-12-31", Kind: overtimeExpiry, Seconds: -3 * 3600, Reason: "surplus from 2025-11 expired"}},
+			0},
+		{"expiry across the end of the year", overtimePolicy{ExpiryMonths: 2},
+			[]adjustment{{Date: "2025-11-10", Kind: overtimeCorrection, Seconds: 4 * 3600}}, "2026-02-10",
+			[]adjustment{{Date: "2026-01-31", Kind: overtimeExpiry, Seconds: -4 * 3600, Reason: "surplus from 2025-11 expired"}},
+			0},
+		{"not expired before its time", overtimePolicy{ExpiryMonths: 2},
+			[]adjustment{{Date: "2025-11-10", Kind: overtimeCorrection, Seconds: 4 * 3600}}, "2026-01-30",
+			nil, 4},
+		// capping first would take 3 hours of October's surplus and leave November's 4 hours plus 1 of October's,
+		// which would then expire and leave 4 hours either way, but with a cap transaction that shouldn't be there
+		{"expiry before the cap", overtimePolicy{Cap: 5 * 3600, ExpiryMonths: 1},
+			[]adjustment{
+				{Date: "2025-10-05", Kind: overtimeCorrection, Seconds: 4 * 3600},
+				{Date: "2025-11-05", Kind: overtimeCorrection, Seconds: 4 * 3600},
+			}, "2025-12-15",
+			[]adjustment{{Date: "2025-11-30", Kind: overtimeExpiry, Seconds: -4 * 3600, Reason: "surplus from 2025-10 expired"}},
+			4},
+		{"cap what's left after expiry", overtimePolicy{Cap: 5 * 3600, ExpiryMonths: 1},
+			[]adjustment{
+				{Date: "2025-10-05", Kind: overtimeCorrection, Seconds: 4 * 3600},
+				{Date: "2025-11-05", Kind: overtimeCorrection, Seconds: 7 * 3600},
+			}, "2025-12-15",
+			[]adjustment{
+				{Date: "2025-11-30", Kind: overtimeExpiry, Seconds: -4 * 3600, Reason: "surplus from 2025-10 expired"},
+				{Date: "2025-11-30", Kind: overtimeCap, Seconds: -2 * 3600, Reason: "capped at 5h0m0s"},
+			}, 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, uid, cleanup := newTestOvertime(t)
+			defer cleanup()
+
+			for _, a := range test.adjustments {
+				a.Reason, a.CreatedBy = "test", uid
+				_, err := addAdjustment(db, uid, a)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			to, err := time.ParseInLocation(dateLayout, test.to, time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			days, ledger, err := getOvertime(db, uid, to, test.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []adjustment
+			for _, a := range ledger {
+				if a.Kind == overtimeExpiry || a.Kind == overtimeCap {
+					a.Balance = 0
+					got = append(got, a)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("transactions = %+v, want %+v", got, test.want)
+			}
+			if balance := days[len(days)-1].balance; balance != test.balance*3600 {
+				t.Errorf("balance = %vh, want %dh", float64(balance)/3600, test.balance)
+			}
+		})
+	}
+}
+
+func TestGetBalanceClosing(t *testing.T) {
+	db, uid, cleanup := newTestOvertime(t)
+	defer cleanup()
+
+	var policy overtimePolicy
+	for _, a := range []adjustment{
+		{Date: "2025-10-05", Kind: overtimeCorrection, Seconds: 10 * 3600},
+		{Date: "2025-12-05", Kind: overtimePayout, Seconds: -4 * 3600},
+		{Date: "2026-04-05", Kind: overtimeCorrection, Seconds: 3 * 3600},
+	} {
+		a.Reason, a.CreatedBy = "test", uid
+		_, err := addAdjustment(db, uid, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now().In(time.UTC)
+	check := func(want int) {
+		t.Helper()
+		days, _, err := getOvertime(db, uid, now, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if walked := days[len(days)-1].balance; walked != want {
+			t.Fatalf("walked balance = %d, want %d", walked, want)
+		}
+		balance, err := getBalance(db, uid, now, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance != want {
+			t.Errorf("balance = %d, want %d", balance, want)
+		}
+	}
+
+	check(9 * 3600)
+	var month string
+	err := db.QueryRow("SELECT month FROM balance_closings WHERE uid = ?", uid).Scan(&month)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := reportPeriods["month"](now).Format(dateLayout); month != want {
+		t.Errorf("closed at %s, want %s", month, want)
+	}
+
+	// the stored closing is used as long as nothing changed
+	_, err = db.Exec("UPDATE balance_closings SET balance_s = balance_s + 3600 WHERE uid = ?", uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balance, err := getBalance(db, uid, now, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 10*3600 {
+		t.Errorf("balance from the closing = %d, want %d", balance, 10*3600)
+	}
+
+	// and isn't once something did, or under another policy
+	_, err = addAdjustment(db, uid, adjustment{Date: "2026-05-05", Kind: overtimeCorrection, Seconds: 3600, Reason: "test", CreatedBy: uid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(10 * 3600)
+	policy.Cap = 2 * 3600
+	check(2 * 3600)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/argon2"
+)
+
+// hashParams are stored along with every hash so that they can be changed
+// without making the existing hashes useless
+type hashParams struct {
+	Time       uint32 `json:"time"`
+	Memory     uint32 `json:"memory"` // KiB
+	Threads    uint8  `json:"threads"`
+	SaltLength int    `json:"saltLength"`
+	KeyLength  uint32 `json:"keyLength"`
+}
+
+// validate rejects parameters argon2 can't work with, or that make for weak hashes
+func (p hashParams) validate() (err error) {
+	if p.Time < 1 || p.Threads < 1 || p.Memory < 8*uint32(p.Threads) {
+		return stacktrace.NewError("time and threads have to be at least 1, memory at least 8 KiB per thread")
+	}
+	if p.SaltLength < 8 || p.KeyLength < 16 {
+		return stacktrace.NewError("salts have to be at least 8 bytes long, keys at least 16")
+	}
+	return nil
+}
+
+// legacyHashParams were used before the parameters were stored
+var legacyHashParams = hashParams{Time: 1, Memory: 64 * 1024, Threads: 1, SaltLength: 8, KeyLength: 16}
+
+// encodeHash produces a PHC string format hash, e.g. $argon2id$v=19$m=65536,t=1,p=1$<salt>$<key>
+func encodeHash(p hashParams, salt, key []byte) string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func decodeHash(encoded string) (p hashParams, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" {
+		return p, nil, nil, stacktrace.NewError("malformed hash")
+	}
+	if parts[1] != "argon2id" {
+		return p, nil, nil, stacktrace.NewError("unsupported algorithm " + parts[1])
+	}
+
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return p, nil, nil, stacktrace.NewError("unsupported argon2 version " + parts[2])
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads)
+	if err != nil {
+		return p, nil, nil, stacktrace.Propagate(err, "malformed parameters")
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, stacktrace.Propagate(err, "malformed salt")
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, stacktrace.Propagate(err, "malformed key")
+	}
+	p.SaltLength = len(salt)
+	p.KeyLength = uint32(len(key))
+
+	return p, salt, key, stacktrace.Propagate(p.validate(), "invalid parameters")
+}
+
+func hashPassword(password string, p hashParams) (encoded string) {
+	salt := make([]byte, p.SaltLength)
+	rand.Read(salt)
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLength)
+	return encodeHash(p, salt, key)
+}
+
+// verifyNoPassword takes as long as verifying a password hashed with p, it's for logins with addresses
+// nobody has, so that how long they take doesn't tell which addresses belong to someone
+func verifyNoPassword(password string, p hashParams) {
+	verifyPassword(encodeHash(p, make([]byte, p.SaltLength), make([]byte, p.KeyLength)), password)
+}
+
+// verifyPassword also returns the parameters the hash was made with, to tell if it's outdated
+func verifyPassword(encoded, password string) (ok bool, p hashParams, err error) {
+	p, salt, key, err := decodeHash(encoded)
+	if err != nil {
+		return false, p, stacktrace.Propagate(err, "failed to decode hash")
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLength)
+	return subtle.ConstantTimeCompare(computed, key) == 1, p, nil
+}
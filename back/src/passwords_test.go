@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestVerifyPassword(t *testing.T) {
+	p := hashParams{Time: 1, Memory: 1024, Threads: 1, SaltLength: 16, KeyLength: 32}
+	encoded := hashPassword("hunter2", p)
+
+	ok, got, err := verifyPassword(encoded, "hunter2")
+	if err != nil || !ok {
+		t.Fatalf("correct password: ok %v, err %v", ok, err)
+	}
+	if got != p {
+		t.Errorf("parameters = %+v, want %+v", got, p)
+	}
+
+	ok, _, err = verifyPassword(encoded, "hunter3")
+	if err != nil || ok {
+		t.Errorf("wrong password: ok %v, err %v", ok, err)
+	}
+}
+
+func TestHashParamsValidate(t *testing.T) {
+	valid := hashParams{Time: 1, Memory: 64 * 1024, Threads: 4, SaltLength: 16, KeyLength: 32}
+	if err := valid.validate(); err != nil {
+		t.Errorf("%+v: %v", valid, err)
+	}
+	if err := legacyHashParams.validate(); err != nil {
+		t.Errorf("legacy parameters: %v", err)
+	}
+
+	invalid := []hashParams{
+		{Time: 1, Memory: 64 * 1024, Threads: 0, SaltLength: 16, KeyLength: 32},
+		{Time: 0, Memory: 64 * 1024, Threads: 1, SaltLength: 16, KeyLength: 32},
+		{Time: 1, Memory: 8, Threads: 4, SaltLength: 16, KeyLength: 32},
+		{Time: 1, Memory: 64 * 1024, Threads: 1, SaltLength: 0, KeyLength: 32},
+		{Time: 1, Memory: 64 * 1024, Threads: 1, SaltLength: 16, KeyLength: 0},
+	}
+	for _, p := range invalid {
+		if p.validate() == nil {
+			t.Errorf("%+v was accepted", p)
+		}
+	}
+}
+
+// hashes with parameters argon2 would panic on are rejected instead
+func TestDecodeHashInvalidParams(t *testing.T) {
+	encoded := "$argon2id$v=19$m=65536,t=1,p=0$c2FsdHNhbHRzYWx0$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5"
+	ok, _, err := verifyPassword(encoded, "hunter2")
+	if err == nil || ok {
+		t.Errorf("ok %v, err %v", ok, err)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// what happens to shifts that nobody clocked out of, the policy is recorded on the entry that closes them
+const (
+	policyDisqualify = "disqualify" // at midnight, the shift doesn't count
+	policyClockOut   = "clockOut"   // at a time of day, the shift counts unless it started after that
+	policySchedule   = "schedule"   // at midnight, the shift counts up to the time expected that day
+	policyKeepOpen   = "keepOpen"   // for night shifts, disqualified after the given number of hours
+)
+
+type clockOutPolicy struct {
+	Kind  string `json:"kind"`
+	At    string `json:"at,omitempty"`    // like 18:00, only for clockOut
+	Hours int    `json:"hours,omitempty"` // only for keepOpen
+}
+
+var errInvalidPolicy = errors.New("invalid clock-out policy")
+
+func (p clockOutPolicy) validate() (err error) {
+	switch p.Kind {
+	case policyDisqualify, policySchedule:
+		return nil
+	case policyClockOut:
+		_, err = time.Parse("15:04", p.At)
+		if err != nil {
+			return stacktrace.Propagate(errInvalidPolicy, "malformed time of day")
+		}
+		return nil
+	case policyKeepOpen:
+		if p.Hours < 1 || p.Hours > 48 {
+			return stacktrace.Propagate(errInvalidPolicy, "hours out of range")
+		}
+		return nil
+	}
+	return stacktrace.Propagate(errInvalidPolicy, "unknown kind %q", p.Kind)
+}
+
+// nextMidnight returns the start of the day after the one t is on
+func nextMidnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+}
+
+// closingTime returns when a shift started at since is due to be closed under the policy, when the entry it
+// leaves behind ends, whether it counts, and why it was closed, which is recorded on the entry
+func (p clockOutPolicy) closingTime(db *sql.DB, uid uidT, since time.Time) (due, to time.Time, valid bool, reason string, err error) {
+	midnight := nextMidnight(since)
+	switch p.Kind {
+	case policyClockOut:
+		at, _ := time.ParseInLocation("15:04", p.At, since.Location())
+		at = time.Date(since.Year(), since.Month(), since.Day(), at.Hour(), at.Minute(), 0, 0, since.Location())
+		if !at.After(since) { // the shift started after it, so it would only be closed the next day
+			return midnight, midnight, false, "not clocked out by midnight, started after " + p.At, nil
+		}
+		return at, at, true, "clocked out automatically at " + p.At, nil
+	case policySchedule:
+		expected, err := getExpectedForDay(db, uid, since)
+		if err != nil {
+			return due, to, false, "", stacktrace.Propagate(err, "failed to get expected time")
+		}
+		if expected > 0 {
+			// only once the day is over, until then they may still be working
+			to = since.Add(time.Duration(expected) * time.Second)
+			if to.After(midnight) {
+				to = midnight
+			}
+			return midnight, to, true, "capped at the scheduled " + (time.Duration(expected) * time.Second).String(), nil
+		}
+		return midnight, midnight, false, "not clocked out by midnight, nothing was scheduled", nil
+	case policyKeepOpen:
+		to = since.Add(time.Duration(p.Hours) * time.Hour)
+		return to, to, false, "not clocked out within " + strconv.Itoa(p.Hours) + " hours", nil
+	}
+	return midnight, midnight, false, "not clocked out by midnight", nil
+}
+
+// getTeamPolicy returns nil if the team inherits its policy
+func getTeamPolicy(db execer, id teamIDT) (p *clockOutPolicy, err error) {
+	var js sql.NullString
+	err = db.QueryRow("SELECT clock_out_policy FROM teams WHERE team_id = ?", id).Scan(&js)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to get policy")
+	}
+	if !js.Valid {
+		return nil, nil
+	}
+
+	p = &clockOutPolicy{}
+	err = json.Unmarshal([]byte(js.String), p)
+	return p, stacktrace.Propagate(err, "malformed policy")
+}
+
+// setTeamPolicy makes the team inherit its policy again if p is nil
+func setTeamPolicy(db execer, id teamIDT, p *clockOutPolicy) (err error) {
+	var js interface{}
+	if p != nil {
+		raw, _ := json.Marshal(p)
+		js = string(raw)
+	}
+
+	_, err = db.Exec("UPDATE teams SET clock_out_policy = ?1 WHERE team_id = ?2", js, id)
+	return stacktrace.Propagate(err, "failed to set policy")
+}
+
+// getUserTeamSetting looks for a value of the column in the user's teams and then in the teams above them,
+// going up one level at a time. Teams of the same level are tried in the order they were created in
+func getUserTeamSetting(db *sql.DB, uid uidT, column string) (value sql.NullString, err error) {
+	rows, err := db.Query("SELECT team_id FROM team_members WHERE uid = ? ORDER BY team_id", uid)
+	if err != nil {
+		return value, stacktrace.Propagate(err, "failed to list teams")
+	}
+	var level []teamIDT
+	for rows.Next() {
+		var id teamIDT
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return value, stacktrace.Propagate(err, "failed to scan row")
+		}
+		level = append(level, id)
+	}
+	rows.Close()
+
+	seen := make(map[teamIDT]bool) // guards against cycles
+	for len(level) > 0 {
+		var parents []teamIDT
+		for _, id := range level {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			var parent teamIDT
+			err = db.QueryRow("SELECT "+column+", COALESCE(parent_id, 0) FROM teams WHERE team_id = ?", id).Scan(&value, &parent)
+			if err != nil {
+				return value, stacktrace.Propagate(err, "failed to get team setting")
+			}
+			if value.Valid {
+				return value, nil
+			}
+			if parent != 0 {
+				parents = append(parents, parent)
+			}
+		}
+		level = parents
+	}
+
+	return value, nil
+}
+
+// getUserPolicy falls back to the policy from the config if none of the user's teams has one
+func getUserPolicy(db *sql.DB, uid uidT, fallback clockOutPolicy) (p clockOutPolicy, err error) {
+	js, err := getUserTeamSetting(db, uid, "clock_out_policy")
+	if err != nil {
+		return p, stacktrace.Propagate(err, "")
+	}
+	if !js.Valid {
+		return fallback, nil
+	}
+
+	err = json.Unmarshal([]byte(js.String), &p)
+	return p, stacktrace.Propagate(err, "malformed policy")
+}
+
+// closeForgottenShifts applies the policy of each user who's clocked in to their shift, the shifts are closed
+// at the time the policy says in the user's time zone, e.g. their midnight, not at the time this runs
+func closeForgottenShifts(db *sql.DB, fallback clockOutPolicy, fallbackLoc *time.Location) {
+	rows, err := db.Query("SELECT uid, since_unix_s FROM user_states WHERE state = 'I'")
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to select open shifts"))
+		return
+	}
+
+	type userSince struct {
+		uid   uidT
+		since int
+	}
+	open := []userSince{}
+
+	for rows.Next() {
+		var us userSince
+		err = rows.Scan(&us.uid, &us.since)
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to scan row"))
+			continue
+		}
+		open = append(open, us)
+	}
+	rows.Close()
+
+	now := time.Now()
+	for _, x := range open {
+		p, err := getUserPolicy(db, x.uid, fallback)
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to get policy of "+strconv.Itoa(int(x.uid))))
+			continue
+		}
+
+		loc, err := getUserLocation(db, x.uid, fallbackLoc)
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to get time zone of "+strconv.Itoa(int(x.uid))))
+			continue
+		}
+
+		due, to, valid, reason, err := p.closingTime(db, x.uid, time.Unix(int64(x.since), 0).In(loc))
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to get closing time of "+strconv.Itoa(int(x.uid))))
+			continue
+		}
+		if due.After(now) {
+			continue
+		}
+
+		err = closeShift(db, x.uid, x.since, int(to.Unix()), valid, p.Kind, reason)
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to close shift of "+strconv.Itoa(int(x.uid))))
+		}
+	}
+}
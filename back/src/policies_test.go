@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClosingTime(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	uid := newTestUser(t, db, "test@invalid", []role{roleEmployee})
+	// 10 hours on Sunday, 8 on weekdays, nothing on Saturday
+	err := setSchedule(db, uid, schedule{"2026-01-01", [7]int{36000, 28800, 28800, 28800, 28800, 28800, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loc, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) time.Time {
+		parsed, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		name    string
+		policy  clockOutPolicy
+		since   string
+		due, to string
+		valid   bool
+	}{
+		{"disqualify", clockOutPolicy{Kind: policyDisqualify}, "2026-03-02 08:00", "2026-03-03 00:00", "2026-03-03 00:00", false},
+		{"clock out later that day", clockOutPolicy{Kind: policyClockOut, At: "18:00"}, "2026-03-02 08:00", "2026-03-02 18:00", "2026-03-02 18:00", true},
+		{"clock out after it", clockOutPolicy{Kind: policyClockOut, At: "18:00"}, "2026-03-02 19:00", "2026-03-03 00:00", "2026-03-03 00:00", false},
+		{"clock out right at it", clockOutPolicy{Kind: policyClockOut, At: "18:00"}, "2026-03-02 18:00", "2026-03-03 00:00", "2026-03-03 00:00", false},
+		{"schedule", clockOutPolicy{Kind: policySchedule}, "2026-03-02 08:00", "2026-03-03 00:00", "2026-03-02 16:00", true},
+		{"schedule past midnight", clockOutPolicy{Kind: policySchedule}, "2026-03-02 20:00", "2026-03-03 00:00", "2026-03-03 00:00", true},
+		{"schedule on a day off", clockOutPolicy{Kind: policySchedule}, "2026-03-07 08:00", "2026-03-08 00:00", "2026-03-08 00:00", false},
+		// the clocks go forward, the day is 23 hours long
+		{"schedule on a short day", clockOutPolicy{Kind: policySchedule}, "2026-03-29 00:00", "2026-03-30 00:00", "2026-03-29 11:00", true},
+		{"schedule past midnight on a short day", clockOutPolicy{Kind: policySchedule}, "2026-03-29 16:00", "2026-03-30 00:00", "2026-03-30 00:00", true},
+		{"keep open", clockOutPolicy{Kind: policyKeepOpen, Hours: 12}, "2026-03-02 22:00", "2026-03-03 10:00", "2026-03-03 10:00", false},
+		{"keep open over the change of clocks", clockOutPolicy{Kind: policyKeepOpen, Hours: 12}, "2026-03-28 22:00", "2026-03-29 11:00", "2026-03-29 11:00", false},
+	}
+
+	for _, test := range tests {
+		due, to, valid, reason, err := test.policy.closingTime(db, uid, at(test.since))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !due.Equal(at(test.due)) || !to.Equal(at(test.to)) || valid != test.valid {
+			t.Errorf("%s: closingTime = %s, %s, %v, want %s, %s, %v", test.name,
+				due.Format("2006-01-02 15:04"), to.Format("2006-01-02 15:04"), valid, test.due, test.to, test.valid)
+		}
+		if reason == "" {
+			t.Errorf("%s: no reason", test.name)
+		}
+	}
+}
+
+func TestNextMidnight(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		t     time.Time
+		want  time.Time
+		hours float64 // since the start of the day
+	}{
+		{time.Date(2026, 3, 2, 10, 0, 0, 0, loc), time.Date(2026, 3, 3, 0, 0, 0, 0, loc), 24},
+		{time.Date(2026, 3, 29, 10, 0, 0, 0, loc), time.Date(2026, 3, 30, 0, 0, 0, 0, loc), 23},
+		{time.Date(2026, 10, 25, 10, 0, 0, 0, loc), time.Date(2026, 10, 26, 0, 0, 0, 0, loc), 25},
+		{time.Date(2026, 12, 31, 23, 59, 0, 0, loc), time.Date(2027, 1, 1, 0, 0, 0, 0, loc), 24},
+	}
+
+	for _, test := range tests {
+		got := nextMidnight(test.t)
+		if !got.Equal(test.want) {
+			t.Errorf("nextMidnight(%s) = %s, want %s", test.t, got, test.want)
+		}
+		if hours := got.Sub(startOfDay(test.t)).Hours(); hours != test.hours {
+			t.Errorf("%s is %v hours long, want %v", test.t.Format(dateLayout), hours, test.hours)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// The balance is the overtime a user has accumulated, every day from their start date on adds what they worked
+// and subtracts what they were expected to work, and the adjustments in the overtime ledger are added to it
+
+// reportPeriods return the first day of the period the day is in
+var reportPeriods = map[string]func(day time.Time) time.Time{
+	"day": func(day time.Time) time.Time { return day },
+	"week": func(day time.Time) time.Time { // ISO weeks, which start on Monday
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	},
+	"month": func(day time.Time) time.Time {
+		return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, day.Location())
+	},
+	"year": func(day time.Time) time.Time {
+		return time.Date(day.Year(), 1, 1, 0, 0, 0, 0, day.Location())
+	},
+}
+
+type reportPeriod struct {
+	Start       string `json:"start"` // see dateLayout, the period may be cut off by the start of the report or the ledger
+	Worked      int    `json:"worked"`
+	Expected    int    `json:"expected"`
+	Delta       int    `json:"delta"`
+	Adjustments int    `json:"adjustments"` // see getOvertime
+	Balance     int    `json:"balance"`     // at the end of the period
+}
+
+type report struct {
+	StartDate string         `json:"startDate"`
+	Periods   []reportPeriod `json:"periods"`
+}
+
+// getBalanceStart returns the user's start date in loc, which is the day of their first entry unless
+// it was set, or today if there are none
+func getBalanceStart(db *sql.DB, uid uidT, loc *time.Location) (start time.Time, err error) {
+	var date sql.NullString
+	err = db.QueryRow("SELECT start_date FROM users WHERE uid = ?", uid).Scan(&date)
+	if err != nil {
+		return start, stacktrace.Propagate(err, "failed to get start date")
+	}
+	if date.Valid {
+		start, err = time.ParseInLocation(dateLayout, date.String, loc)
+		return start, stacktrace.Propagate(err, "malformed start date")
+	}
+
+	var first sql.NullInt64
+	err = db.QueryRow("SELECT MIN(from_unix_s) FROM entries WHERE uid = ?", uid).Scan(&first)
+	if err != nil {
+		return start, stacktrace.Propagate(err, "failed to get first entry")
+	}
+	if !first.Valid {
+		return startOfDay(time.Now().In(loc)), nil
+	}
+	return startOfDay(time.Unix(first.Int64, 0).In(loc)), nil
+}
+
+// getReport sums up the days from from to to, both inclusive, by the period, which is a key of reportPeriods.
+// Both dates are in the user's location, the balance is counted from the start of the ledger either way
+func getReport(db *sql.DB, uid uidT, from, to time.Time, period string, fallback overtimePolicy) (r report, err error) {
+	periodStart, ok := reportPeriods[period]
+	if !ok {
+		return r, stacktrace.NewError("unknown period %q", period)
+	}
+
+	start, err := getBalanceStart(db, uid, from.Location())
+	if err != nil {
+		return r, stacktrace.Propagate(err, "")
+	}
+	r.StartDate = start.Format(dateLayout)
+	r.Periods = make([]reportPeriod, 0) // doesn't marshal to null
+
+	days, _, err := getOvertime(db, uid, to, fallback)
+	if err != nil {
+		return r, stacktrace.Propagate(err, "")
+	}
+
+	for _, d := range days {
+		if d.date.Before(startOfDay(from)) {
+			continue
+		}
+
+		key := periodStart(d.date).Format(dateLayout)
+		if len(r.Periods) == 0 || r.Periods[len(r.Periods)-1].Start != key {
+			r.Periods = append(r.Periods, reportPeriod{Start: key})
+		}
+		p := &r.Periods[len(r.Periods)-1]
+		p.Worked += d.worked
+		p.Expected += d.expected
+		p.Delta = p.Worked - p.Expected
+		p.Adjustments += d.adjusted
+		p.Balance = d.balance
+	}
+
+	return r, nil
+}
+
+// getBalance returns the user's balance at the end of the date. The status is polled, and walking the balance from
+// the start gets slower the longer the user has been around, so the walk is picked up at the start of the month where
+// the last one stored it, unless something that could have changed it was audited since, see lastBalanceAuditID
+func getBalance(db *sql.DB, uid uidT, date time.Time, fallback overtimePolicy) (balance int, err error) {
+	policy, err := getUserOvertimePolicy(db, uid, fallback)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	stamp := closingStamp(date.Location(), policy)
+	// before walking, so that a change made meanwhile makes what's stored stale
+	auditID, err := lastBalanceAuditID(db, uid)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	// an open shift keeps changing the days it's counted towards until it's closed, which is audited
+	var openSince int64
+	err = db.QueryRow("SELECT COALESCE(MAX(since_unix_s), 0) FROM user_states WHERE uid = ? AND state = 'I'",
+		uid).Scan(&openSince)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to get state")
+	}
+	closes := func(c balanceClosing) bool {
+		return !c.month.IsZero() && (openSince == 0 || openSince >= c.month.Unix())
+	}
+
+	from, err := getBalanceClosing(db, uid, auditID, stamp, date.Location())
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	if from != nil && (!closes(*from) || from.month.After(date)) {
+		from = nil
+	}
+
+	days, _, closing, err := walkOvertime(db, uid, date, policy, from)
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "")
+	}
+	if closes(closing) && (from == nil || !closing.month.Equal(from.month)) {
+		err = setBalanceClosing(db, uid, auditID, stamp, closing)
+		if err != nil {
+			return 0, stacktrace.Propagate(err, "")
+		}
+	}
+
+	if len(days) == 0 { // the ledger starts later
+		return 0, nil
+	}
+	return days[len(days)-1].balance, nil
+}
+
+// setUserBalanceStart makes the start date that of the user's first entry again if date is empty
+func setUserBalanceStart(db execer, uid uidT, date string) (err error) {
+	_, err = db.Exec("UPDATE users SET start_date = NULLIF(?1, '') WHERE uid = ?2", date, uid)
+	return stacktrace.Propagate(err, "failed to set start date")
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+type role string
+
+const (
+	roleEmployee role = "employee"
+	roleManager  role = "manager"
+	roleHR       role = "hr"
+	rolePayroll  role = "payroll"
+	roleAuditor  role = "auditor"
+	roleAdmin    role = "admin"
+)
+
+var allRoles = []role{roleEmployee, roleManager, roleHR, rolePayroll, roleAuditor, roleAdmin}
+
+// permission is what an /a route requires, see the routes function
+type permission string
+
+const (
+	permEntriesRead      permission = "entries.read"
+	permEntriesEdit      permission = "entries.edit"
+	permUsersRead        permission = "users.read"
+	permUsersManage      permission = "users.manage"
+	permUsersClock       permission = "users.clock"
+	permRolesManage      permission = "roles.manage"
+	permTeamsManage      permission = "teams.manage"
+	permSchedulesRead    permission = "schedules.read"
+	permSchedulesManage  permission = "schedules.manage"
+	permLeaveRead        permission = "leave.read"
+	permLeaveDecide      permission = "leave.decide"
+	permLeaveTypesManage permission = "leaveTypes.manage"
+	permHolidaysManage   permission = "holidays.manage"
+	permSecurityRead     permission = "security.read"
+	permSecurityManage   permission = "security.manage"
+	permAuditRead        permission = "audit.read"
+	permOvertimeManage   permission = "overtime.manage"
+)
+
+// rolePermissions lists what each role may do, employees can only use /u routes
+var rolePermissions = map[role][]permission{
+	roleEmployee: {},
+	roleManager: {permEntriesRead, permEntriesEdit, permUsersRead, permUsersClock,
+		permSchedulesRead, permLeaveRead, permLeaveDecide},
+	roleHR: {permEntriesRead, permUsersRead, permUsersManage, permTeamsManage, permSchedulesRead, permSchedulesManage,
+		permLeaveRead, permLeaveDecide, permLeaveTypesManage, permHolidaysManage, permAuditRead, permOvertimeManage},
+	rolePayroll: {permEntriesRead, permUsersRead, permSchedulesRead, permLeaveRead, permOvertimeManage},
+	roleAuditor: {permEntriesRead, permUsersRead, permSchedulesRead, permLeaveRead, permSecurityRead, permAuditRead},
+	roleAdmin: {permEntriesRead, permEntriesEdit, permUsersRead, permUsersManage, permUsersClock, permRolesManage, permTeamsManage,
+		permSchedulesRead, permSchedulesManage, permLeaveRead, permLeaveDecide, permLeaveTypesManage,
+		permHolidaysManage, permSecurityRead, permSecurityManage, permAuditRead, permOvertimeManage},
+}
+
+// teamScopedRoles only grant their permissions for the members of the teams the user manages
+var teamScopedRoles = map[role]bool{roleManager: true}
+
+var errUnknownRole = errors.New("unknown role")
+
+func parseRoles(s string) (roles []role, err error) {
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := rolePermissions[role(name)]; !ok {
+			return nil, stacktrace.Propagate(errUnknownRole, name)
+		}
+		roles = append(roles, role(name))
+	}
+	return roles, nil
+}
+
+func getRoles(db *sql.DB, uid uidT) (roles []role, err error) {
+	rows, err := db.Query("SELECT role FROM user_roles WHERE uid = ? ORDER BY role", uid)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to get roles")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r role
+		err = rows.Scan(&r)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		roles = append(roles, r)
+	}
+
+	return roles, nil
+}
+
+// setRoles replaces all of the user's roles, which is why it has to be done in a transaction
+func setRoles(tx *sql.Tx, uid uidT, roles []role) (err error) {
+	_, err = tx.Exec("DELETE FROM user_roles WHERE uid = ?", uid)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to delete roles")
+	}
+
+	for _, r := range roles {
+		_, err = tx.Exec("INSERT OR IGNORE INTO user_roles (uid, role) VALUES (?1, ?2)", uid, r)
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to insert role")
+		}
+	}
+	return nil
+}
+
+// checkPermission tells whether any of the user's roles grant the permission for everyone,
+// or only for the members of the teams they manage
+func checkPermission(db *sql.DB, uid uidT, p permission) (everyone, team bool, err error) {
+	roles, err := getRoles(db, uid)
+	if err != nil {
+		return false, false, stacktrace.Propagate(err, "")
+	}
+
+	for _, r := range roles {
+		for _, granted := range rolePermissions[r] {
+			if granted != p {
+				continue
+			}
+			if teamScopedRoles[r] {
+				team = true
+			} else {
+				everyone = true
+			}
+		}
+	}
+	return everyone, team, nil
+}
+
+// listPermissions lists everything the roles allow, regardless of scope
+func listPermissions(roles []role) (permissions []permission) {
+	seen := make(map[permission]bool)
+	for _, r := range roles {
+		for _, p := range rolePermissions[r] {
+			if !seen[p] {
+				seen[p] = true
+				permissions = append(permissions, p)
+			}
+		}
+	}
+	return permissions
+}
+
+// managesUser is false for the manager themselves, so that they can't approve their own requests
+func managesUser(db *sql.DB, manager, uid uidT) (manages bool, err error) {
+	if manager == uid {
+		return false, nil
+	}
+
+	err = db.QueryRow("SELECT 1 FROM managed_users WHERE manager_uid = ?1 AND uid = ?2", manager, uid).Scan(new(int))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, stacktrace.Propagate(err, "failed to check team membership")
+}
+
+// holdsPermissionsOf tells whether the actor's roles grant every permission the target's do. Only then may
+// they change the target's password, email or whether they're active, otherwise they could log in as someone
+// who may do more than them. Team scoped roles of the actor don't count, they don't reach everyone
+func holdsPermissionsOf(db *sql.DB, actor, target uidT) (holds bool, err error) {
+	actorRoles, err := getRoles(db, actor)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "")
+	}
+	targetRoles, err := getRoles(db, target)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "")
+	}
+
+	held := make(map[permission]bool)
+	for _, r := range actorRoles {
+		if teamScopedRoles[r] {
+			continue
+		}
+		for _, p := range rolePermissions[r] {
+			held[p] = true
+		}
+	}
+	for _, r := range targetRoles {
+		for _, p := range rolePermissions[r] {
+			if !held[p] {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// isLastAdmin tells whether the user is the only active admin, who can't be
+// deactivated or lose the role, so that there's someone left who can give out roles
+func isLastAdmin(db *sql.DB, u userInfo) (last bool, err error) {
+	admin := false
+	for _, r := range u.Roles {
+		admin = admin || r == roleAdmin
+	}
+	if !admin || !u.Active {
+		return false, nil
+	}
+
+	admins, err := countUsersWithRole(db, roleAdmin)
+	return admins <= 1, stacktrace.Propagate(err, "")
+}
+
+func countUsersWithRole(db *sql.DB, r role) (count int, err error) {
+	err = db.QueryRow(
+		`SELECT COUNT(*) FROM user_roles JOIN users ON user_roles.uid = users.uid
+			WHERE role = ? AND active = 1`, r).Scan(&count)
+	return count, stacktrace.Propagate(err, "failed to count users")
+}
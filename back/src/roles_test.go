@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestHoldsPermissionsOf(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	uids := make(map[role]uidT)
+	for _, r := range []role{roleEmployee, roleManager, roleHR, roleAdmin} {
+		uids[r] = newTestUser(t, db, string(r)+"@invalid", []role{r})
+	}
+
+	tests := []struct {
+		actor, target role
+		want          bool
+	}{
+		{roleHR, roleEmployee, true},
+		{roleHR, roleHR, true},
+		{roleHR, roleAdmin, false},
+		{roleHR, roleManager, false}, // managers may edit entries
+		{roleManager, roleEmployee, true},
+		{roleManager, roleHR, false},
+		{roleAdmin, roleHR, true},
+		{roleAdmin, roleAdmin, true},
+	}
+	for _, test := range tests {
+		got, err := holdsPermissionsOf(db, uids[test.actor], uids[test.target])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("holdsPermissionsOf(%s, %s) = %v, want %v", test.actor, test.target, got, test.want)
+		}
+	}
+}
+
+func TestIsLastAdmin(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	first := newTestUser(t, db, "first@invalid", []role{roleAdmin})
+	employee := newTestUser(t, db, "employee@invalid", []role{roleEmployee})
+
+	check := func(uid uidT, want bool) {
+		t.Helper()
+		u, err := getUser(db, uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last, err := isLastAdmin(db, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last != want {
+			t.Errorf("isLastAdmin(%d) = %v, want %v", uid, last, want)
+		}
+	}
+
+	check(first, true)
+	check(employee, false)
+
+	second := newTestUser(t, db, "second@invalid", []role{roleAdmin})
+	check(first, false)
+
+	err := deactivateUser(db, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(first, true)
+	check(second, false) // already inactive
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/AndrewBurian/powermux"
@@ -20,23 +24,110 @@ type key int
 const (
 	sidKey key = iota
 	uidKey
+	managerKey // set by can, see managedBy
 )
 
 func routes(mux *powermux.ServeMux, env env) {
 	mux.Route("/").MiddlewareFunc(env.corsMiddleware)
 	mux.Route("/version").GetFunc(env.version)
 	mux.Route("/authorize").PostFunc(env.authorize)
+	mux.Route("/authorize/totp").PostFunc(env.authorizeTOTP)
+	mux.Route("/password/reset").PostFunc(env.passwordReset)
+	mux.Route("/confirm").PostFunc(env.confirm)
+	mux.Route("/confirm/resend").PostFunc(env.confirmResend)
+	mux.Route("/password/reset/request").PostFunc(env.passwordResetRequest)
 	u := mux.Route("/u").MiddlewareFunc(env.requireSession)
 	u.Route("/status").GetFunc(env.status)
 	u.Route("/entries").GetFunc(env.entries)
+	u.Route("/report").GetFunc(env.reportOwn)
+	u.Route("/overtime").GetFunc(env.overtimeOwn)
 	u.Route("/clock/in").PutFunc(env.clockIn)
 	u.Route("/clock/out").PutFunc(env.clockOut)
+	u.Route("/password").PutFunc(env.passwordChange)
+	u.Route("/email").PutFunc(env.emailChange)
+	u.Route("/logout").PostFunc(env.logout)
+	u.Route("/totp").GetFunc(env.totpStatus).PostFunc(env.totpBegin).PutFunc(env.totpConfirm).DeleteFunc(env.totpDisable)
+	u.Route("/totp/recovery").PostFunc(env.totpRecoveryCodes)
+	u.Route("/sessions").GetFunc(env.sessionsOwn).DeleteFunc(env.sessionsRevokeOthers)
+	u.Route("/sessions/:id").DeleteFunc(env.sessionsRevoke)
+	u.Route("/roles").GetFunc(env.rolesOwn)
+	u.Route("/keys").GetFunc(env.keysOwn).PostFunc(env.keysCreateOwn)
+	u.Route("/keys/:id").DeleteFunc(env.keysRevokeOwn)
 	u.Route("/users/online/count").GetFunc(env.usersOnlineCount)
-	a := mux.Route("/a").MiddlewareFunc(env.requireSession).MiddlewareFunc(env.requireAdmin)
-	a.Route("/entries/:id").PutFunc(env.entriesEdit)
-	a.Route("/entries/:id").DeleteFunc(env.entriesDelete)
-	a.Route("/users/:id")
-	a.Route("/users/online/list").GetFunc(env.usersOnlineList)
+	u.Route("/teams").GetFunc(env.teamsOwn)
+	u.Route("/holidays").GetFunc(env.holidaysList)
+	u.Route("/schedules").GetFunc(env.schedulesOwn)
+	u.Route("/leave").GetFunc(env.leaveOwn).PostFunc(env.leaveRequest)
+	u.Route("/leave/types").GetFunc(env.leaveTypes)
+	u.Route("/leave/:id").DeleteFunc(env.leaveCancel)
+	u.Route("/corrections").GetFunc(env.correctionsOwn).PostFunc(env.correctionsRequest)
+	u.Route("/corrections/:id").DeleteFunc(env.correctionsCancel)
+	a := mux.Route("/a").MiddlewareFunc(env.requireSession)
+	a.Route("/entries/:id").PutFunc(env.can(permEntriesEdit, targetEntry, env.entriesEdit))
+	a.Route("/entries/:id").DeleteFunc(env.can(permEntriesEdit, targetEntry, env.entriesDelete))
+	a.Route("/entries/:id/reinstate").PutFunc(env.can(permEntriesEdit, targetEntry, env.entriesReinstate))
+	a.Route("/users/:id/entries").PostFunc(env.can(permEntriesEdit, targetUser, env.entriesAdd))
+	a.Route("/users/:id/report").GetFunc(env.can(permEntriesRead, targetUser, env.reportUser))
+	a.Route("/users/:id/overtime").GetFunc(env.can(permEntriesRead, targetUser, env.overtimeUser)).
+		PostFunc(env.can(permOvertimeManage, targetUser, env.overtimeAdjust))
+	a.Route("/roles").GetFunc(env.can(permUsersRead, nil, env.rolesList))
+	a.Route("/users").GetFunc(env.can(permUsersRead, nil, env.usersList)).PostFunc(env.can(permUsersManage, nil, env.usersCreate))
+	a.Route("/users/:id").GetFunc(env.can(permUsersRead, targetUser, env.usersGet)).
+		PutFunc(env.can(permUsersManage, targetUser, env.usersUpdate)).
+		DeleteFunc(env.can(permUsersManage, targetUser, env.usersDeactivate))
+	a.Route("/users/:id/roles").PutFunc(env.can(permRolesManage, targetUser, env.usersSetRoles))
+	a.Route("/users/:id/password").PutFunc(env.can(permUsersManage, targetUser, env.usersResetPassword))
+	a.Route("/users/:id/sessions").GetFunc(env.can(permSecurityRead, targetUser, env.sessionsList)).
+		DeleteFunc(env.can(permSecurityManage, targetUser, env.sessionsRevokeAll))
+	a.Route("/users/:id/sessions/:session").DeleteFunc(env.can(permSecurityManage, targetUser, env.sessionsRevokeUser))
+	a.Route("/users/:id/keys").GetFunc(env.can(permSecurityRead, targetUser, env.keysList)).
+		PostFunc(env.can(permSecurityManage, targetUser, env.keysCreate))
+	a.Route("/users/:id/keys/:key").DeleteFunc(env.can(permSecurityManage, targetUser, env.keysRevoke))
+	a.Route("/users/:id/clock/in").PutFunc(env.can(permUsersClock, targetUser, env.usersClockIn))
+	a.Route("/users/:id/clock/out").PutFunc(env.can(permUsersClock, targetUser, env.usersClockOut))
+	a.Route("/users/:id/schedules").GetFunc(env.can(permSchedulesRead, targetUser, env.schedulesList)).
+		PostFunc(env.can(permSchedulesManage, targetUser, env.schedulesSet))
+	a.Route("/users/:id/schedules/:from").DeleteFunc(env.can(permSchedulesManage, targetUser, env.schedulesDelete))
+	a.Route("/users/online/list").GetFunc(env.can(permUsersRead, nil, env.usersOnlineList))
+	a.Route("/teams").GetFunc(env.can(permUsersRead, nil, env.teamsList)).PostFunc(env.can(permTeamsManage, nil, env.teamsCreate))
+	a.Route("/teams/:id").GetFunc(env.can(permUsersRead, targetTeam, env.teamsGet)).
+		PutFunc(env.can(permTeamsManage, targetTeam, env.teamsUpdate)).
+		DeleteFunc(env.can(permTeamsManage, targetTeam, env.teamsDelete))
+	a.Route("/teams/:id/members/:member").PutFunc(env.can(permTeamsManage, targetTeam, env.teamsSetMember)).
+		DeleteFunc(env.can(permTeamsManage, targetTeam, env.teamsRemoveMember))
+	a.Route("/teams/:id/policy").GetFunc(env.can(permUsersRead, targetTeam, env.teamsGetPolicy)).
+		PutFunc(env.can(permTeamsManage, targetTeam, env.teamsSetPolicy)).
+		DeleteFunc(env.can(permTeamsManage, targetTeam, env.teamsInheritPolicy))
+	a.Route("/teams/:id/shifts").GetFunc(env.can(permUsersRead, targetTeam, env.teamsGetShifts)).
+		PutFunc(env.can(permTeamsManage, targetTeam, env.teamsSetShifts))
+	a.Route("/teams/:id/timezone").GetFunc(env.can(permUsersRead, targetTeam, env.teamsGetTimeZone)).
+		PutFunc(env.can(permTeamsManage, targetTeam, env.teamsSetTimeZone))
+	a.Route("/teams/:id/overtime").GetFunc(env.can(permUsersRead, targetTeam, env.teamsGetOvertime)).
+		PutFunc(env.can(permTeamsManage, targetTeam, env.teamsSetOvertime)).
+		DeleteFunc(env.can(permTeamsManage, targetTeam, env.teamsInheritOvertime))
+	a.Route("/teams/:id/online").GetFunc(env.can(permUsersRead, targetTeam, env.teamsOnline))
+	a.Route("/teams/:id/balances").GetFunc(env.can(permEntriesRead, targetTeam, env.teamsBalances))
+	a.Route("/leave").GetFunc(env.can(permLeaveRead, nil, env.leaveList))
+	a.Route("/leave/types").PostFunc(env.can(permLeaveTypesManage, nil, env.leaveTypesAdd))
+	a.Route("/leave/:id/approve").PutFunc(env.can(permLeaveDecide, targetLeave, env.leaveApprove))
+	a.Route("/leave/:id/reject").PutFunc(env.can(permLeaveDecide, targetLeave, env.leaveReject))
+	a.Route("/corrections").GetFunc(env.can(permEntriesRead, nil, env.correctionsList))
+	a.Route("/corrections/:id/approve").PutFunc(env.can(permEntriesEdit, targetCorrection, env.correctionsApprove))
+	a.Route("/corrections/:id/reject").PutFunc(env.can(permEntriesEdit, targetCorrection, env.correctionsReject))
+	a.Route("/users/:id/totp").PutFunc(env.can(permSecurityManage, targetUser, env.totpRequire)).
+		DeleteFunc(env.can(permSecurityManage, targetUser, env.totpReset))
+	a.Route("/users/:id/lockout").DeleteFunc(env.can(permSecurityManage, targetUser, env.lockoutsClearUser))
+	a.Route("/lockouts").GetFunc(env.can(permSecurityRead, nil, env.lockoutsList))
+	a.Route("/lockouts/ips/:ip").DeleteFunc(env.can(permSecurityManage, nil, env.lockoutsClearIP))
+	a.Route("/logins").GetFunc(env.can(permSecurityRead, nil, env.loginsList))
+	a.Route("/audit").GetFunc(env.can(permAuditRead, nil, env.auditList))
+	a.Route("/audit/verify").GetFunc(env.can(permAuditRead, nil, env.auditVerify))
+	a.Route("/audit/checkpoint").GetFunc(env.can(permAuditRead, nil, env.auditCheckpoint))
+	a.Route("/holidays").GetFunc(env.can(permHolidaysManage, nil, env.holidaysList)).
+		PostFunc(env.can(permHolidaysManage, nil, env.holidaysAdd))
+	a.Route("/holidays/:date").DeleteFunc(env.can(permHolidaysManage, nil, env.holidaysDelete))
+	a.Route("/holidays/generate").PostFunc(env.can(permHolidaysManage, nil, env.holidaysGenerate))
+	a.Route("/holidays/import").PostFunc(env.can(permHolidaysManage, nil, env.holidaysImport))
 }
 
 func do400(w http.ResponseWriter) {
@@ -49,11 +140,63 @@ func do401(w http.ResponseWriter) {
 	w.Write([]byte("401 Unauthorized"))
 }
 
+func do404(w http.ResponseWriter) {
+	w.WriteHeader(404)
+	w.Write([]byte("404 Not Found"))
+}
+
+func do409(w http.ResponseWriter) {
+	w.WriteHeader(409)
+	w.Write([]byte("409 Conflict"))
+}
+
+func do403(w http.ResponseWriter) {
+	w.WriteHeader(403)
+	w.Write([]byte("403 Forbidden"))
+}
+
+func do429(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+	w.WriteHeader(429)
+	w.Write([]byte("429 Too Many Requests"))
+}
+
 func do500(w http.ResponseWriter) {
 	w.WriteHeader(500)
 	w.Write([]byte("500 Internal Server Error"))
 }
 
+// pathUID parses the :id path parameter of /a/users/:id routes
+func pathUID(r *http.Request) (uid uidT, err error) {
+	intUID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	return uidT(intUID), err
+}
+
+// formBool parses flags the way the API spells them, 1 or true and 0 or false
+func formBool(str string) (value bool, err error) {
+	switch str {
+	case "1", "true":
+		return true, nil
+	case "0", "false":
+		return false, nil
+	}
+	return false, stacktrace.NewError("malformed flag " + str)
+}
+
+func (env *env) clientIP(r *http.Request) string {
+	if env.conf.TrustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func (env *env) version(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(strconv.Itoa(apiVersion)))
 }
@@ -69,26 +212,162 @@ func (env *env) corsMiddleware(w http.ResponseWriter, r *http.Request, n func(ht
 	}
 }
 
-func (env *env) requireAdmin(w http.ResponseWriter, r *http.Request, n func(http.ResponseWriter, *http.Request)) {
-	uid, ok := r.Context().Value(uidKey).(uidT)
-	if !ok {
-		fmt.Println(stacktrace.NewError("malformed context, use requireSession first"))
-		do500(w)
-		return
+// targetFunc tells whether the manager manages whoever a request is about,
+// so that permissions scoped to teams can be checked
+type targetFunc func(db *sql.DB, r *http.Request, manager uidT) (manages bool, err error)
+
+var errMalformedPath = errors.New("malformed path parameter")
+
+func targetUser(db *sql.DB, r *http.Request, manager uidT) (manages bool, err error) {
+	uid, err := pathUID(r)
+	if err != nil {
+		return false, stacktrace.Propagate(errMalformedPath, "")
 	}
+	return managesUser(db, manager, uid)
+}
 
-	admin, err := checkAdmin(env.db, uid)
+func targetEntry(db *sql.DB, r *http.Request, manager uidT) (manages bool, err error) {
+	eid, err := strconv.Atoi(powermux.PathParam(r, "id"))
 	if err != nil {
-		fmt.Println(stacktrace.Propagate(err, "checkAdmin failed"))
-		do500(w)
-		return
+		return false, stacktrace.Propagate(errMalformedPath, "")
 	}
-	if !admin {
-		do401(w)
-		return
+	var uid uidT
+	err = db.QueryRow("SELECT uid FROM entries WHERE eid = ?", eid).Scan(&uid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to get entry")
+	}
+	return managesUser(db, manager, uid)
+}
+
+func targetLeave(db *sql.DB, r *http.Request, manager uidT) (manages bool, err error) {
+	lid, err := pathLID(r)
+	if err != nil {
+		return false, stacktrace.Propagate(errMalformedPath, "")
+	}
+	var uid uidT
+	err = db.QueryRow("SELECT uid FROM leave WHERE lid = ?", lid).Scan(&uid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to get leave")
+	}
+	return managesUser(db, manager, uid)
+}
+
+func targetCorrection(db *sql.DB, r *http.Request, manager uidT) (manages bool, err error) {
+	cid, err := pathCID(r)
+	if err != nil {
+		return false, stacktrace.Propagate(errMalformedPath, "")
+	}
+	var uid uidT
+	err = db.QueryRow("SELECT uid FROM corrections WHERE cid = ?", cid).Scan(&uid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to get correction")
 	}
+	return managesUser(db, manager, uid)
+}
+
+func targetTeam(db *sql.DB, r *http.Request, manager uidT) (manages bool, err error) {
+	team, err := pathTeamID(r)
+	if err != nil {
+		return false, stacktrace.Propagate(errMalformedPath, "")
+	}
+	_, err = getTeam(db, team)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "")
+	}
+	return managesTeam(db, manager, team)
+}
+
+// can only lets the request through if the user has the permission, use requireSession first.
+// Users whose permission only applies to their teams get 403 for anyone else if the route
+// has a target, routes without one have to narrow down what they show using managedBy
+func (env *env) can(p permission, target targetFunc, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, ok := r.Context().Value(uidKey).(uidT)
+		if !ok {
+			fmt.Println(stacktrace.NewError("malformed context, use requireSession first"))
+			do500(w)
+			return
+		}
+
+		everyone, team, err := checkPermission(env.db, uid, p)
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to check permission"))
+			do500(w)
+			return
+		}
+		if everyone {
+			h(w, r)
+			return
+		}
+		if !team {
+			do403(w)
+			return
+		}
+
+		if target == nil {
+			h(w, r.WithContext(context.WithValue(r.Context(), managerKey, uid)))
+			return
+		}
+
+		manages, err := target(env.db, r, uid)
+		switch stacktrace.RootCause(err) {
+		case nil:
+		case errMalformedPath:
+			do400(w)
+			return
+		case sql.ErrNoRows:
+			do404(w)
+			return
+		default:
+			fmt.Println(stacktrace.Propagate(err, ""))
+			do500(w)
+			return
+		}
+
+		if !manages {
+			do403(w)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// audited makes an admin change and records it with the reason sent along with it, in the same transaction
+// so that neither happens without the other. change mustn't use env.db, the transaction holds the lock on it
+func (env *env) audited(r *http.Request, change func(tx *sql.Tx) (a auditEntry, err error)) (err error) {
+	actor, _ := r.Context().Value(uidKey).(uidT)
+
+	tx, err := env.db.Begin()
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to begin transaction")
+	}
+
+	a, err := change(tx)
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "")
+	}
+
+	err = recordAudit(tx, actor, a.action, a.uid, a.target, a.before, a.after, r.FormValue("reason"))
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "")
+	}
+
+	return stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
 
-	n(w, r)
+// managedBy is the manager whose team members a list has to be narrowed down to, 0 for no one
+func managedBy(r *http.Request) uidT {
+	manager, _ := r.Context().Value(managerKey).(uidT)
+	return manager
 }
 
 func (env *env) requireSession(w http.ResponseWriter, r *http.Request, n func(http.ResponseWriter, *http.Request)) {
@@ -99,6 +378,11 @@ func (env *env) requireSession(w http.ResponseWriter, r *http.Request, n func(ht
 		return
 	}
 
+	if strings.HasPrefix(h[7:], apiKeyPrefix) {
+		env.requireAPIKey(w, r, n, h[7:])
+		return
+	}
+
 	sid := sidT(h[7:])
 	uid, err := getUserBySession(env.db, sid)
 	if err != nil {
@@ -106,11 +390,63 @@ func (env *env) requireSession(w http.ResponseWriter, r *http.Request, n func(ht
 		return
 	}
 
+	err = touchSession(env.db, sid, env.conf.SessionAbsolute.Duration, env.conf.SessionIdle.Duration)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to touch session"))
+	}
+
+	// users who have to use two-factor authentication can't do anything else until they set it up
+	totpEnabled, totpRequired, err := getTOTPStatus(env.db, uid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if totpRequired && !totpEnabled && !strings.HasPrefix(r.URL.Path, "/u/totp") && r.URL.Path != "/u/logout" {
+		do403(w)
+		return
+	}
+
 	ctx := context.WithValue(r.Context(), sidKey, sid)
 	ctx = context.WithValue(ctx, uidKey, uid)
 	n(w, r.WithContext(ctx))
 }
 
+func (env *env) requireAPIKey(w http.ResponseWriter, r *http.Request, n func(http.ResponseWriter, *http.Request), key string) {
+	uid, scope, err := getUserByAPIKey(env.db, key)
+	if stacktrace.RootCause(err) == errInvalidToken {
+		do401(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	// keys of deactivated users are kept in case they're reactivated
+	active, err := checkActive(env.db, uid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !active {
+		do401(w)
+		return
+	}
+
+	if !scope.allows(r.Method, r.URL.Path) {
+		do403(w)
+		return
+	}
+
+	// there's no session, so logging out does nothing and revoking the other sessions revokes all of them
+	ctx := context.WithValue(r.Context(), sidKey, sidT(""))
+	ctx = context.WithValue(ctx, uidKey, uid)
+	n(w, r.WithContext(ctx))
+}
+
 func (env *env) status(w http.ResponseWriter, r *http.Request) {
 	uid, ok := r.Context().Value(uidKey).(uidT)
 	if !ok {
@@ -119,15 +455,25 @@ func (env *env) status(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	team, err := formTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
 	info := struct {
-		State         string `json:"state"`
-		Since         int    `json:"since"`
-		Online        int    `json:"online"`
-		DeltaForMonth int    `json:"deltaForMonth"`
-		DeltaForDay   int    `json:"deltaForDay"`
+		State               string       `json:"state"`
+		Since               int          `json:"since"`
+		Online              int          `json:"online"`
+		DeltaForMonth       int          `json:"deltaForMonth"`
+		DeltaForDay         int          `json:"deltaForDay"`
+		Balance             int          `json:"balance"` // carried across months, see getReport
+		PendingCorrections  []correction `json:"pendingCorrections"`
+		CorrectionsToDecide int          `json:"correctionsToDecide"` // 0 for anyone who can't decide them
+		TimeZone            string       `json:"timeZone"`            // the one days are counted in
 	}{}
 
-	online, err := countOnlineUsers(env.db)
+	online, err := countOnlineUsers(env.db, team)
 	info.Online = online
 	if err != nil {
 		fmt.Println(stacktrace.Propagate(err, "failed to count online users"))
@@ -135,7 +481,16 @@ func (env *env) status(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	deltaForMonth, err := getDeltaForMonth(env.db, uid, time.Now())
+	loc, err := getUserLocation(env.db, uid, env.loc)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	info.TimeZone = loc.String()
+
+	deltaForMonth, err := getDeltaForMonth(env.db, uid, time.Now().In(loc))
 	info.DeltaForMonth = deltaForMonth
 	if err != nil {
 		fmt.Println(stacktrace.Propagate(err, "failed to get monthly delta"))
@@ -143,7 +498,7 @@ func (env *env) status(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	deltaForDay, err := getDeltaForDay(env.db, uid, time.Now())
+	deltaForDay, err := getDeltaForDay(env.db, uid, time.Now().In(loc))
 	info.DeltaForDay = deltaForDay
 	if err != nil {
 		fmt.Println(stacktrace.Propagate(err, "failed to get daily delta"))
@@ -151,6 +506,13 @@ func (env *env) status(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	info.Balance, err = getBalance(env.db, uid, time.Now().In(loc), env.conf.OvertimePolicy)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to get balance"))
+		do500(w)
+		return
+	}
+
 	err = env.db.QueryRow("SELECT state, since_unix_s FROM user_states WHERE uid = ?", uid).Scan(&info.State, &info.Since)
 	if err != nil {
 		fmt.Println(stacktrace.Propagate(err, "failed to get user info"))
@@ -158,6 +520,30 @@ func (env *env) status(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	info.PendingCorrections, err = listCorrections(env.db, uid, "P", 0)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to list corrections"))
+		do500(w)
+		return
+	}
+	if info.PendingCorrections == nil { // empty list
+		info.PendingCorrections = make([]correction, 0) // doesn't marshal to null
+	}
+
+	everyone, scoped, err := checkPermission(env.db, uid, permEntriesEdit)
+	if err == nil && (everyone || scoped) {
+		manager := uid
+		if everyone {
+			manager = 0
+		}
+		info.CorrectionsToDecide, err = countCorrectionsToDecide(env.db, uid, manager)
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to count corrections to decide"))
+		do500(w)
+		return
+	}
+
 	js, _ := json.Marshal(info)
 	w.Write([]byte(js))
 }
@@ -170,7 +556,7 @@ func (env *env) clockIn(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := clockIn(env.db, uid)
+	err := clockIn(env.db, uid, uid)
 	if err != nil {
 		fmt.Println(stacktrace.Propagate(err, "failed to clock in"))
 		do500(w)
@@ -186,7 +572,7 @@ func (env *env) clockOut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := clockOut(env.db, uid)
+	err := clockOut(env.db, uid, uid)
 	if err != nil {
 		fmt.Println(stacktrace.Propagate(err, "failed to clock out"))
 		do500(w)
@@ -194,6 +580,7 @@ func (env *env) clockOut(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// entries takes the optional filters from, to and valid, order (asc or desc), limit and after for paging, and format
 func (env *env) entries(w http.ResponseWriter, r *http.Request) {
 	uid, ok := r.Context().Value(uidKey).(uidT)
 	if !ok {
@@ -202,19 +589,104 @@ func (env *env) entries(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	entries, err := listEntries(env.db, uid)
+	loc, err := getUserLocation(env.db, uid, env.loc)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	// from and to are dates in the user's time zone, both inclusive
+	f := entryFilter{UID: uid, Valid: -1, Desc: r.Form.Get("order") == "desc"}
+	if strFrom := r.Form.Get("from"); strFrom != "" {
+		from, err := time.ParseInLocation(dateLayout, strFrom, loc)
+		if err != nil {
+			do400(w)
+			return
+		}
+		f.From = int(from.Unix())
+	}
+	if strTo := r.Form.Get("to"); strTo != "" {
+		to, err := time.ParseInLocation(dateLayout, strTo, loc)
+		if err != nil {
+			do400(w)
+			return
+		}
+		f.To = int(nextMidnight(to).Unix())
+	}
+	if strValid := r.Form.Get("valid"); strValid != "" {
+		valid, err := formBool(strValid)
+		if err != nil {
+			do400(w)
+			return
+		}
+		f.Valid = 0
+		if valid {
+			f.Valid = 1
+		}
+	}
+
+	// after takes the eid of the last entry of the previous page, the whole history isn't sent at once
+	f.Limit = 1000
+	params := map[string]*int{"after": (*int)(&f.After), "limit": &f.Limit}
+	for name, x := range params {
+		if str := r.Form.Get(name); str != "" {
+			*x, err = strconv.Atoi(str)
+			if err != nil {
+				do400(w)
+				return
+			}
+		}
+	}
+	if f.Limit < 1 || f.Limit > 1000 {
+		do400(w)
+		return
+	}
+
+	entries, err := listEntries(env.db, f)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	// format=list gives the entries as they are instead of under the days they span
+	if r.Form.Get("format") == "list" {
+		if entries == nil { // empty list
+			entries = make([]entry, 0) // doesn't marshal to null
+		}
+
+		js, _ := json.Marshal(entries)
+		w.Write([]byte(js))
+		return
+	}
+
+	days, err := groupEntriesByDay(env.db, uid, entries, loc, f.From, f.To)
 	if err != nil {
 		fmt.Println(stacktrace.Propagate(err, ""))
 		do500(w)
 		return
 	}
 
-	js, _ := json.Marshal(entries)
+	js, _ := json.Marshal(days)
 	w.Write([]byte(js))
 }
 
 func (env *env) entriesEdit(w http.ResponseWriter, r *http.Request) {
-	strEID := powermux.PathParam(r, "eid")
+	actor, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	strEID := powermux.PathParam(r, "id")
 	intEID, err := strconv.Atoi(strEID)
 	eid := eidT(intEID)
 	if err != nil {
@@ -245,7 +717,22 @@ func (env *env) entriesEdit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = editEntry(env.db, eid, from, to)
+	// the audit log has to say why entries were changed
+	reason := r.Form.Get("reason")
+	if reason == "" {
+		do400(w)
+		return
+	}
+
+	err = editEntry(env.db, eid, from, to, actor, reason)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if stacktrace.RootCause(err) == errEntryOverlap {
+		do409(w)
+		return
+	}
 	if err != nil {
 		fmt.Println(stacktrace.Propagate(err, ""))
 		do500(w)
@@ -254,7 +741,14 @@ func (env *env) entriesEdit(w http.ResponseWriter, r *http.Request) {
 }
 
 func (env *env) entriesDelete(w http.ResponseWriter, r *http.Request) {
-	strEID := powermux.PathParam(r, "eid")
+	actor, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	strEID := powermux.PathParam(r, "id")
 	intEID, err := strconv.Atoi(strEID)
 	eid := eidT(intEID)
 	if err != nil {
@@ -262,7 +756,145 @@ func (env *env) entriesDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = deleteEntry(env.db, eid)
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	reason := r.Form.Get("reason") // see entriesEdit
+	if reason == "" {
+		do400(w)
+		return
+	}
+
+	err = deleteEntry(env.db, eid, actor, reason)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+// entriesAdd takes from, to and a reason like entriesEdit, and optionally valid, which defaults to true
+func (env *env) entriesAdd(w http.ResponseWriter, r *http.Request) {
+	actor, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	from, err := strconv.Atoi(r.Form.Get("from"))
+	if err != nil {
+		do400(w)
+		return
+	}
+	to, err := strconv.Atoi(r.Form.Get("to"))
+	if err != nil {
+		do400(w)
+		return
+	}
+	if to < from || to > int(time.Now().Unix()) {
+		do400(w)
+		return
+	}
+	valid := r.Form.Get("valid") != "0" && r.Form.Get("valid") != "false"
+
+	reason := r.Form.Get("reason")
+	if reason == "" {
+		do400(w)
+		return
+	}
+
+	_, err = getUser(env.db, uid)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	eid, err := addEntry(env.db, uid, from, to, valid, actor, reason)
+	if stacktrace.RootCause(err) == errEntryOverlap {
+		do409(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		EID eidT `json:"eid"`
+	}{eid})
+	w.Write([]byte(js))
+}
+
+// entriesReinstate takes the time the disqualified entry should have ended at and a reason
+func (env *env) entriesReinstate(w http.ResponseWriter, r *http.Request) {
+	actor, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	intEID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	eid := eidT(intEID)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+	to, err := strconv.Atoi(r.Form.Get("to"))
+	if err != nil || to > int(time.Now().Unix()) {
+		do400(w)
+		return
+	}
+
+	reason := r.Form.Get("reason")
+	if reason == "" {
+		do400(w)
+		return
+	}
+
+	err = reinstateEntry(env.db, eid, to, actor, reason)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if stacktrace.RootCause(err) == errEntryEnd {
+		do400(w)
+		return
+	}
+	if stacktrace.RootCause(err) == errEntryValid || stacktrace.RootCause(err) == errEntryOverlap {
+		do409(w)
+		return
+	}
 	if err != nil {
 		fmt.Println(stacktrace.Propagate(err, ""))
 		do500(w)
@@ -271,7 +903,13 @@ func (env *env) entriesDelete(w http.ResponseWriter, r *http.Request) {
 }
 
 func (env *env) usersOnlineCount(w http.ResponseWriter, r *http.Request) {
-	onlineUsers, err := countOnlineUsers(env.db)
+	team, err := formTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	onlineUsers, err := countOnlineUsers(env.db, team)
 	if err != nil {
 		fmt.Print(stacktrace.Propagate(err, "failed to count online users"))
 		do500(w)
@@ -282,7 +920,13 @@ func (env *env) usersOnlineCount(w http.ResponseWriter, r *http.Request) {
 }
 
 func (env *env) usersOnlineList(w http.ResponseWriter, r *http.Request) {
-	onlineUsers, err := listOnlineUsers(env.db)
+	team, err := formTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	onlineUsers, err := listOnlineUsers(env.db, managedBy(r), team)
 	if err != nil {
 		fmt.Print(stacktrace.Propagate(err, "failed to list online users"))
 		do500(w)
@@ -311,19 +955,112 @@ func (env *env) authorize(w http.ResponseWriter, r *http.Request) {
 	f := form{}
 	json.Unmarshal(body, &f)
 
+	ip := env.clientIP(r)
+	wait, err := checkThrottle(env.db, throttleIP, ip)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to check IP throttle"))
+		do500(w)
+		return
+	}
+	if wait > 0 {
+		do429(w, wait)
+		return
+	}
+
+	// the same for every address, whether it belongs to anyone or not, see throttleEmail
+	emailKey := emailThrottleKey(f.Email)
+	wait, err = checkThrottle(env.db, throttleEmail, emailKey)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to check email throttle"))
+		do500(w)
+		return
+	}
+	if wait > 0 {
+		do429(w, wait)
+		return
+	}
+
 	uid, err := emailToUID(env.db, f.Email)
 	if err != nil {
+		uid = 0
+	}
+
+	ok, current := false, hashParams{}
+	if uid > 0 {
+		ok, current = checkPassword(env.db, uid, f.Password)
+	} else {
+		verifyNoPassword(f.Password, env.conf.PasswordHash)
+	}
+	err = recordLoginAttempt(env.db, f.Email, uid, ip, ok)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+	}
+	if !ok {
+		err = recordFailure(env.db, throttleIP, ip, env.conf.Login)
+		if err == nil {
+			err = recordFailure(env.db, throttleEmail, emailKey, env.conf.Login)
+		}
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, ""))
+		}
 		do401(w)
 		return
 	}
 
-	ok := checkPassword(env.db, uid, f.Password)
-	if !ok {
+	err = clearThrottle(env.db, throttleEmail, emailKey)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+	}
+
+	err = rehashPassword(env.db, uid, f.Password, current, env.conf.PasswordHash)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+	}
+
+	active, err := checkActive(env.db, uid)
+	if err != nil || !active {
 		do401(w)
 		return
 	}
 
-	sid, err := createSession(env.db, uid, time.Hour*24*31)
+	verified, err := checkVerified(env.db, uid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to check verification"))
+		do500(w)
+		return
+	}
+	if env.conf.RequireVerification && !verified {
+		do403(w)
+		return
+	}
+
+	totpEnabled, _, err := getTOTPStatus(env.db, uid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if totpEnabled {
+		// the session is only created once a code is sent to /authorize/totp
+		challenge, err := createChallenge(env.db, uid, time.Minute*5)
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, ""))
+			do500(w)
+			return
+		}
+
+		js, _ := json.Marshal(struct {
+			Challenge string `json:"challenge"`
+		}{challenge})
+		w.Write([]byte(js))
+		return
+	}
+
+	env.startSession(w, r, uid)
+}
+
+func (env *env) startSession(w http.ResponseWriter, r *http.Request, uid uidT) {
+	sid, err := createSession(env.db, uid, env.conf.SessionAbsolute.Duration, env.conf.SessionIdle.Duration, env.clientIP(r), r.UserAgent())
 	if err != nil {
 		fmt.Println(stacktrace.Propagate(err, "failed to create a session"))
 		do500(w)
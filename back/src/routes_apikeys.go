@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/AndrewBurian/powermux"
+	"github.com/palantir/stacktrace"
+)
+
+func writeAPIKeys(w http.ResponseWriter, keys []apiKey) {
+	if keys == nil { // empty list
+		keys = make([]apiKey, 0) // doesn't marshal to null
+	}
+
+	js, _ := json.Marshal(keys)
+	w.Write([]byte(js))
+}
+
+func (env *env) keysCreateFor(w http.ResponseWriter, r *http.Request, uid uidT) {
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	name := r.Form.Get("name")
+	if name == "" {
+		do400(w)
+		return
+	}
+
+	scope := apiKeyScope(r.Form.Get("scope"))
+	var id keyIDT
+	var key string
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		id, key, err = createAPIKey(tx, uid, name, scope)
+		return auditEntry{auditKeyCreate, uid, keyTarget(id), nil, map[string]interface{}{"name": name, "scope": scope}}, err
+	})
+	if stacktrace.RootCause(err) == errUnknownScope {
+		do400(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		ID  keyIDT `json:"id"`
+		Key string `json:"key"` // only ever shown here
+	}{id, key})
+	w.Write([]byte(js))
+}
+
+func (env *env) keysRevokeFor(w http.ResponseWriter, r *http.Request, uid uidT, param string) {
+	id, err := strconv.Atoi(param)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		found, err := deleteAPIKey(tx, uid, keyIDT(id))
+		if err == nil && !found {
+			err = sql.ErrNoRows
+		}
+		return auditEntry{auditKeyRevoke, uid, keyTarget(keyIDT(id)), nil, nil}, err
+	})
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) keysOwn(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	keys, err := listAPIKeys(env.db, uid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	writeAPIKeys(w, keys)
+}
+
+func (env *env) keysCreateOwn(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.keysCreateFor(w, r, uid)
+}
+
+func (env *env) keysRevokeOwn(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.keysRevokeFor(w, r, uid, powermux.PathParam(r, "id"))
+}
+
+func (env *env) keysList(w http.ResponseWriter, r *http.Request) {
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	keys, err := listAPIKeys(env.db, uid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	writeAPIKeys(w, keys)
+}
+
+func (env *env) keysCreate(w http.ResponseWriter, r *http.Request) {
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	_, err = getUser(env.db, uid)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	env.keysCreateFor(w, r, uid)
+}
+
+func (env *env) keysRevoke(w http.ResponseWriter, r *http.Request) {
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	env.keysRevokeFor(w, r, uid, powermux.PathParam(r, "key"))
+}
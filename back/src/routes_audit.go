@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+func (env *env) auditList(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	uid, actor, from, to, before, limit := 0, -1, 0, int(time.Now().Unix())+1, 0, 100
+	params := map[string]*int{"uid": &uid, "actor": &actor, "from": &from, "to": &to, "before": &before, "limit": &limit}
+	for name, x := range params {
+		if str := r.Form.Get(name); str != "" {
+			*x, err = strconv.Atoi(str)
+			if err != nil {
+				do400(w)
+				return
+			}
+		}
+	}
+	if limit < 1 || limit > 1000 {
+		do400(w)
+		return
+	}
+
+	records, err := listAudit(env.db, auditFilter{
+		UID:       uidT(uid),
+		Actor:     uidT(actor),
+		Action:    r.Form.Get("action"),
+		From:      from,
+		To:        to,
+		Before:    before,
+		Limit:     limit,
+		ManagedBy: managedBy(r),
+	})
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	if records == nil { // empty list
+		records = make([]auditRecord, 0) // doesn't marshal to null
+	}
+
+	js, _ := json.Marshal(records)
+	w.Write([]byte(js))
+}
+
+// auditVerify and auditCheckpoint cover the whole ledger, so they're not for team managers
+func (env *env) auditVerify(w http.ResponseWriter, r *http.Request) {
+	if managedBy(r) != 0 {
+		do403(w)
+		return
+	}
+
+	report, err := verifyLedger(env.db)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to verify ledger"))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(report)
+	w.Write([]byte(js))
+}
+
+func (env *env) auditCheckpoint(w http.ResponseWriter, r *http.Request) {
+	if managedBy(r) != 0 {
+		do403(w)
+		return
+	}
+
+	c, report, err := createCheckpoint(env.db, env.signer)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to create checkpoint"))
+		do500(w)
+		return
+	}
+	if report.Break != nil {
+		w.WriteHeader(http.StatusConflict)
+		js, _ := json.Marshal(report)
+		w.Write([]byte(js))
+		return
+	}
+
+	js, _ := json.Marshal(c)
+	w.Write([]byte(js))
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AndrewBurian/powermux"
+	"github.com/palantir/stacktrace"
+)
+
+func pathCID(r *http.Request) (cid cidT, err error) {
+	intCID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	return cidT(intCID), err
+}
+
+func writeCorrections(w http.ResponseWriter, corrections []correction) {
+	if corrections == nil { // empty list
+		corrections = make([]correction, 0) // doesn't marshal to null
+	}
+
+	js, _ := json.Marshal(corrections)
+	w.Write([]byte(js))
+}
+
+func (env *env) correctionsOwn(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	corrections, err := listCorrections(env.db, uid, "", 0)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to list corrections"))
+		do500(w)
+		return
+	}
+
+	writeCorrections(w, corrections)
+}
+
+// correctionsRequest takes kind (add, edit or revalidate), eid unless adding, from unless
+// revalidating, to, which is where revalidated entries end, and a reason, which is always required
+func (env *env) correctionsRequest(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	kinds := map[string]string{"add": correctionAdd, "edit": correctionEdit, "revalidate": correctionRevalidate}
+	c := correction{UID: uid, Kind: kinds[r.Form.Get("kind")], Reason: r.Form.Get("reason")}
+	if c.Kind == "" || c.Reason == "" {
+		do400(w)
+		return
+	}
+
+	if c.Kind != correctionAdd {
+		intEID, err := strconv.Atoi(r.Form.Get("eid"))
+		if err != nil {
+			do400(w)
+			return
+		}
+		c.EID = eidT(intEID)
+	}
+
+	if c.Kind != correctionRevalidate {
+		c.From, err = strconv.Atoi(r.Form.Get("from"))
+		if err != nil {
+			do400(w)
+			return
+		}
+	}
+	// revalidated entries may have been closed by a clock-out policy, so the end has to be given
+	c.To, err = strconv.Atoi(r.Form.Get("to"))
+	if err != nil {
+		do400(w)
+		return
+	}
+	if c.To < c.From || c.To > int(time.Now().Unix()) {
+		do400(w)
+		return
+	}
+
+	cid, err := requestCorrection(env.db, c)
+	if stacktrace.RootCause(err) == errCorrectionEntry {
+		do400(w)
+		return
+	}
+	if stacktrace.RootCause(err) == errCorrectionPending || stacktrace.RootCause(err) == errEntryOverlap {
+		do409(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to request correction"))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		CID cidT `json:"cid"`
+	}{cid})
+	w.Write([]byte(js))
+}
+
+func (env *env) correctionsCancel(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	cid, err := pathCID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = cancelCorrection(env.db, uid, cid)
+	if stacktrace.RootCause(err) == errCorrectionNotPending {
+		do409(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) correctionsList(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	uid := uidT(0)
+	if strUID := r.Form.Get("uid"); strUID != "" {
+		intUID, err := strconv.Atoi(strUID)
+		if err != nil {
+			do400(w)
+			return
+		}
+		uid = uidT(intUID)
+	}
+
+	corrections, err := listCorrections(env.db, uid, r.Form.Get("status"), managedBy(r))
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to list corrections"))
+		do500(w)
+		return
+	}
+
+	writeCorrections(w, corrections)
+}
+
+// correctionsDecide records the reason sent along with it as the note of the decision
+func (env *env) correctionsDecide(w http.ResponseWriter, r *http.Request, approve bool) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	cid, err := pathCID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = decideCorrection(env.db, cid, uid, approve, r.FormValue("reason"))
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if stacktrace.RootCause(err) == errOwnCorrection {
+		do403(w)
+		return
+	}
+	if stacktrace.RootCause(err) == errCorrectionNotPending || stacktrace.RootCause(err) == errCorrectionEntry ||
+		stacktrace.RootCause(err) == errEntryOverlap {
+		do409(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) correctionsApprove(w http.ResponseWriter, r *http.Request) {
+	env.correctionsDecide(w, r, true)
+}
+
+func (env *env) correctionsReject(w http.ResponseWriter, r *http.Request) {
+	env.correctionsDecide(w, r, false)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AndrewBurian/powermux"
+	"github.com/palantir/stacktrace"
+)
+
+func (env *env) holidaysList(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	year := time.Now().Year()
+	if strYear := r.Form.Get("year"); strYear != "" {
+		year, err = strconv.Atoi(strYear)
+		if err != nil {
+			do400(w)
+			return
+		}
+	}
+	from := strconv.Itoa(year) + "-01-01"
+	to := strconv.Itoa(year) + "-12-31"
+
+	holidays, err := listHolidays(env.db, from, to)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to list holidays"))
+		do500(w)
+		return
+	}
+
+	if holidays == nil { // empty list
+		holidays = make([]holiday, 0) // doesn't marshal to null
+	}
+
+	js, _ := json.Marshal(holidays)
+	w.Write([]byte(js))
+}
+
+func (env *env) holidaysAdd(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	h := holiday{
+		Date: r.Form.Get("date"),
+		Name: r.Form.Get("name"),
+		Half: r.Form.Get("half") == "1" || r.Form.Get("half") == "true",
+	}
+	day, err := time.Parse(dateLayout, h.Date)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		var before interface{}
+		old, found, err := getHoliday(tx, day)
+		if err != nil {
+			return a, stacktrace.Propagate(err, "")
+		}
+		if found {
+			before = old
+		}
+
+		err = addHoliday(tx, h)
+		return auditEntry{auditHolidayAdd, 0, holidayTarget(h.Date), before, h}, err
+	})
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) holidaysDelete(w http.ResponseWriter, r *http.Request) {
+	date := powermux.PathParam(r, "date")
+	day, err := time.Parse(dateLayout, date)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		before, found, err := getHoliday(tx, day)
+		if err != nil {
+			return a, stacktrace.Propagate(err, "")
+		}
+		if !found {
+			return a, stacktrace.Propagate(sql.ErrNoRows, "")
+		}
+
+		err = deleteHoliday(tx, date)
+		return auditEntry{auditHolidayDelete, 0, holidayTarget(date), before, nil}, err
+	})
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) holidaysGenerate(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	year, err := strconv.Atoi(r.Form.Get("year"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	ruleSet := r.Form.Get("rules")
+	if ruleSet == "" {
+		ruleSet = "pl"
+	}
+	rules, ok := holidayRuleSets[ruleSet]
+	if !ok {
+		do400(w)
+		return
+	}
+
+	holidays := generateHolidays(rules, year)
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		err = addHolidays(tx, holidays)
+		return auditEntry{auditHolidayGenerate, 0, "holidays:" + strconv.Itoa(year), nil, holidays}, err
+	})
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to add generated holidays"))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(holidays)
+	w.Write([]byte(js))
+}
+
+func (env *env) holidaysImport(w http.ResponseWriter, r *http.Request) {
+	holidays, err := parseICS(r.Body)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		err = addHolidays(tx, holidays)
+		return auditEntry{auditHolidayImport, 0, "holidays", nil, holidays}, err
+	})
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to add imported holidays"))
+		do500(w)
+		return
+	}
+
+	if holidays == nil { // empty list
+		holidays = make([]holiday, 0) // doesn't marshal to null
+	}
+
+	js, _ := json.Marshal(holidays)
+	w.Write([]byte(js))
+}
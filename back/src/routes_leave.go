@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AndrewBurian/powermux"
+	"github.com/palantir/stacktrace"
+)
+
+func pathLID(r *http.Request) (lid lidT, err error) {
+	intLID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	return lidT(intLID), err
+}
+
+func writeLeave(w http.ResponseWriter, requests []leaveRequest) {
+	if requests == nil { // empty list
+		requests = make([]leaveRequest, 0) // doesn't marshal to null
+	}
+
+	js, _ := json.Marshal(requests)
+	w.Write([]byte(js))
+}
+
+func (env *env) leaveTypes(w http.ResponseWriter, r *http.Request) {
+	types, err := listLeaveTypes(env.db)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to list leave types"))
+		do500(w)
+		return
+	}
+
+	if types == nil { // empty list
+		types = make([]leaveType, 0) // doesn't marshal to null
+	}
+
+	js, _ := json.Marshal(types)
+	w.Write([]byte(js))
+}
+
+func (env *env) leaveTypesAdd(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	t := leaveType{
+		Code: r.Form.Get("code"),
+		Name: r.Form.Get("name"),
+		Paid: r.Form.Get("paid") == "1" || r.Form.Get("paid") == "true",
+	}
+	if t.Code == "" || t.Name == "" {
+		do400(w)
+		return
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		types, err := listLeaveTypes(tx)
+		if err != nil {
+			return a, stacktrace.Propagate(err, "")
+		}
+		var before interface{}
+		for _, old := range types {
+			if old.Code == t.Code {
+				before = old
+			}
+		}
+
+		err = addLeaveType(tx, t)
+		return auditEntry{auditLeaveTypeAdd, 0, "leaveType:" + t.Code, before, t}, err
+	})
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) leaveOwn(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	requests, err := listLeave(env.db, uid, "", 0, env.loc)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to list leave"))
+		do500(w)
+		return
+	}
+
+	writeLeave(w, requests)
+}
+
+func (env *env) leaveRequest(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	l := leaveRequest{
+		UID:    uid,
+		Type:   r.Form.Get("type"),
+		From:   r.Form.Get("from"),
+		To:     r.Form.Get("to"),
+		Half:   r.Form.Get("half") == "1" || r.Form.Get("half") == "true",
+		Reason: r.Form.Get("reason"),
+	}
+	if l.To == "" {
+		l.To = l.From // a single day
+	}
+	_, err = time.Parse(dateLayout, l.From)
+	if err != nil {
+		do400(w)
+		return
+	}
+	_, err = time.Parse(dateLayout, l.To)
+	if err != nil || l.To < l.From {
+		do400(w)
+		return
+	}
+
+	lid, err := requestLeave(env.db, l)
+	if stacktrace.RootCause(err) == errUnknownLeaveType {
+		do400(w)
+		return
+	}
+	if stacktrace.RootCause(err) == errLeaveOverlap {
+		do409(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to request leave"))
+		do500(w)
+		return
+	}
+
+	l, err = getLeave(env.db, lid, env.loc)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to get leave"))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(l)
+	w.Write([]byte(js))
+}
+
+func (env *env) leaveCancel(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	lid, err := pathLID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = cancelLeave(env.db, uid, lid)
+	if stacktrace.RootCause(err) == errLeaveNotPending {
+		do409(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) leaveList(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	uid := uidT(0)
+	if strUID := r.Form.Get("uid"); strUID != "" {
+		intUID, err := strconv.Atoi(strUID)
+		if err != nil {
+			do400(w)
+			return
+		}
+		uid = uidT(intUID)
+	}
+
+	requests, err := listLeave(env.db, uid, r.Form.Get("status"), managedBy(r), env.loc)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to list leave"))
+		do500(w)
+		return
+	}
+
+	writeLeave(w, requests)
+}
+
+func (env *env) leaveDecide(w http.ResponseWriter, r *http.Request, approve bool) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	lid, err := pathLID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	l, err := getLeave(env.db, lid, env.loc)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	status := "R"
+	if approve {
+		status = "A"
+	}
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		err = decideLeave(tx, lid, uid, approve)
+		return auditEntry{auditLeaveDecide, l.UID, "leave:" + strconv.Itoa(int(lid)),
+			map[string]interface{}{"status": l.Status}, map[string]interface{}{"status": status}}, err
+	})
+	if stacktrace.RootCause(err) == errLeaveNotPending {
+		do409(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) leaveApprove(w http.ResponseWriter, r *http.Request) {
+	env.leaveDecide(w, r, true)
+}
+
+func (env *env) leaveReject(w http.ResponseWriter, r *http.Request) {
+	env.leaveDecide(w, r, false)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+func (env *env) overtimeOwn(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeOvertime(w, uid)
+}
+
+func (env *env) overtimeUser(w http.ResponseWriter, r *http.Request) {
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	_, err = getUser(env.db, uid)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	env.writeOvertime(w, uid)
+}
+
+// writeOvertime writes the user's overtime ledger up to today, with the policy that applies to them
+func (env *env) writeOvertime(w http.ResponseWriter, uid uidT) {
+	loc, err := getUserLocation(env.db, uid, env.loc)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	policy, err := getUserOvertimePolicy(env.db, uid, env.conf.OvertimePolicy)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	days, ledger, err := getOvertime(env.db, uid, time.Now().In(loc), env.conf.OvertimePolicy)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to get overtime"))
+		do500(w)
+		return
+	}
+
+	info := struct {
+		Policy       overtimePolicy `json:"policy"`
+		Balance      int            `json:"balance"`
+		Transactions []adjustment   `json:"transactions"`
+	}{Policy: policy, Transactions: ledger}
+	if len(days) > 0 {
+		info.Balance = days[len(days)-1].balance
+	}
+	if info.Transactions == nil { // empty list
+		info.Transactions = make([]adjustment, 0) // doesn't marshal to null
+	}
+
+	js, _ := json.Marshal(info)
+	w.Write([]byte(js))
+}
+
+// overtimeAdjust takes kind (payout, writeOff, correction or opening), seconds, which are taken off the balance
+// for payouts and write-offs and added to it otherwise, a reason, and a date, today in the user's time zone by default
+// and no earlier than their start date
+func (env *env) overtimeAdjust(w http.ResponseWriter, r *http.Request) {
+	actor, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	a := adjustment{Kind: r.Form.Get("kind"), Date: r.Form.Get("date"), Reason: r.Form.Get("reason"),
+		CreatedBy: actor, CreatedAt: int(time.Now().Unix())}
+	a.Seconds, err = strconv.Atoi(r.Form.Get("seconds"))
+	if err != nil || a.Reason == "" {
+		do400(w)
+		return
+	}
+	switch a.Kind {
+	case overtimePayout, overtimeWriteOff:
+		if a.Seconds <= 0 {
+			do400(w)
+			return
+		}
+		a.Seconds = -a.Seconds
+	case overtimeCorrection, overtimeOpening:
+		if a.Seconds == 0 {
+			do400(w)
+			return
+		}
+	default:
+		do400(w)
+		return
+	}
+
+	_, err = getUser(env.db, uid)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	loc, err := getUserLocation(env.db, uid, env.loc)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if a.Date == "" {
+		a.Date = time.Now().In(loc).Format(dateLayout)
+	}
+	date, err := time.ParseInLocation(dateLayout, a.Date, loc)
+	if err != nil {
+		do400(w)
+		return
+	}
+	// an earlier one would start the balance before the user did, see getOvertime
+	start, err := getBalanceStart(env.db, uid, loc)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if date.Before(start) {
+		do400(w)
+		return
+	}
+
+	id, err := addAdjustment(env.db, uid, a)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to add adjustment"))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		ID adjustmentIDT `json:"id"`
+	}{id})
+	w.Write([]byte(js))
+}
+
+// teamsGetOvertime returns the team's overtime policy, null if inherited
+func (env *env) teamsGetOvertime(w http.ResponseWriter, r *http.Request) {
+	id, err := pathTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	p, err := getTeamOvertimePolicy(env.db, id)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(p)
+	w.Write([]byte(js))
+}
+
+// teamsSetOvertime takes cap in seconds and expiryMonths, both 0 if left out, see overtimePolicy
+func (env *env) teamsSetOvertime(w http.ResponseWriter, r *http.Request) {
+	id, err := pathTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	p := overtimePolicy{}
+	params := map[string]*int{"cap": &p.Cap, "expiryMonths": &p.ExpiryMonths}
+	for name, x := range params {
+		if str := r.Form.Get(name); str != "" {
+			*x, err = strconv.Atoi(str)
+			if err != nil {
+				do400(w)
+				return
+			}
+		}
+	}
+	if p.validate() != nil {
+		do400(w)
+		return
+	}
+
+	env.setOvertimePolicy(w, r, id, &p)
+}
+
+func (env *env) teamsInheritOvertime(w http.ResponseWriter, r *http.Request) {
+	id, err := pathTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	env.setOvertimePolicy(w, r, id, nil)
+}
+
+func (env *env) setOvertimePolicy(w http.ResponseWriter, r *http.Request, id teamIDT, p *overtimePolicy) {
+	err := env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		before, err := getTeamOvertimePolicy(tx, id)
+		if err != nil {
+			return a, stacktrace.Propagate(err, "")
+		}
+
+		err = setTeamOvertimePolicy(tx, id, p)
+		// see setPolicy
+		var jsBefore, jsAfter interface{}
+		if before != nil {
+			jsBefore = before
+		}
+		if p != nil {
+			jsAfter = p
+		}
+		return auditEntry{auditTeamOvertime, 0, teamTarget(id), jsBefore, jsAfter}, err
+	})
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+func (env *env) passwordChange(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+	sid, ok := r.Context().Value(sidKey).(sidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	newPassword := r.Form.Get("new")
+	if newPassword == "" {
+		do400(w)
+		return
+	}
+
+	if ok, _ := checkPassword(env.db, uid, r.Form.Get("old")); !ok {
+		do401(w)
+		return
+	}
+
+	err = setPassword(env.db, uid, newPassword, env.conf.PasswordHash)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	// whoever knew the old password shouldn't stay logged in
+	err = deleteOtherSessions(env.db, uid, sid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to delete other sessions"))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) passwordResetRequest(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		do500(w)
+		return
+	}
+
+	type form struct {
+		Email string `json:"email"`
+	}
+	f := form{}
+	json.Unmarshal(body, &f)
+
+	// the response is the same whether the user exists or not,
+	// so that this can't be used to find out who has an account
+	uid, err := emailToUID(env.db, f.Email)
+	if err != nil {
+		return
+	}
+	active, err := checkActive(env.db, uid)
+	if err != nil || !active {
+		return
+	}
+
+	token, err := createPasswordReset(env.db, uid, time.Hour)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	link := env.conf.FrontendURL + "/#!/reset?token=" + url.QueryEscape(token)
+	go func() {
+		err := env.mailer.send(f.Email, "Password reset",
+			"Someone asked to reset the password of your account.\n"+
+				"If it was you, open the link below within an hour to choose a new one:\n\n"+
+				link+"\n\nOtherwise you can ignore this message.")
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to send password reset mail"))
+		}
+	}()
+}
+
+func (env *env) passwordReset(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		do500(w)
+		return
+	}
+
+	type form struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	f := form{}
+	json.Unmarshal(body, &f)
+
+	if f.Token == "" || f.Password == "" {
+		do400(w)
+		return
+	}
+
+	_, err = usePasswordReset(env.db, f.Token, f.Password, env.conf.PasswordHash)
+	if stacktrace.RootCause(err) == errInvalidToken {
+		do401(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to reset password"))
+		do500(w)
+		return
+	}
+}
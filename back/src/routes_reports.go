@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+func (env *env) reportOwn(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeReport(w, r, uid)
+}
+
+func (env *env) reportUser(w http.ResponseWriter, r *http.Request) {
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	_, err = getUser(env.db, uid)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	env.writeReport(w, r, uid)
+}
+
+// writeReport takes period (day, week, month or year, month by default) and the dates from and to,
+// both inclusive and in the user's time zone, from defaults to the start of the year, to to today, which it can't be after
+func (env *env) writeReport(w http.ResponseWriter, r *http.Request, uid uidT) {
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	loc, err := getUserLocation(env.db, uid, env.loc)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	period := r.Form.Get("period")
+	if period == "" {
+		period = "month"
+	}
+	if _, ok := reportPeriods[period]; !ok {
+		do400(w)
+		return
+	}
+
+	today := startOfDay(time.Now().In(loc))
+	to := today
+	from := reportPeriods["year"](to)
+	dates := map[string]*time.Time{"from": &from, "to": &to}
+	for name, x := range dates {
+		if str := r.Form.Get(name); str != "" {
+			*x, err = time.ParseInLocation(dateLayout, str, loc)
+			if err != nil {
+				do400(w)
+				return
+			}
+		}
+	}
+	// the balance is walked from the start of the ledger to the end of the report, days to come only cost
+	if to.Before(from) || to.After(today) || to.After(from.AddDate(10, 0, 0)) {
+		do400(w)
+		return
+	}
+
+	report, err := getReport(env.db, uid, from, to, period, env.conf.OvertimePolicy)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to get report"))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(report)
+	w.Write([]byte(js))
+}
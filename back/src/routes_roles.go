@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/palantir/stacktrace"
+)
+
+func (env *env) rolesOwn(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	roles, err := getRoles(env.db, uid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	permissions := listPermissions(roles)
+	if roles == nil { // empty list
+		roles = make([]role, 0) // doesn't marshal to null
+	}
+	if permissions == nil { // see above
+		permissions = make([]permission, 0)
+	}
+
+	js, _ := json.Marshal(struct {
+		Roles       []role       `json:"roles"`
+		Permissions []permission `json:"permissions"`
+	}{roles, permissions})
+	w.Write([]byte(js))
+}
+
+func (env *env) rolesList(w http.ResponseWriter, r *http.Request) {
+	type roleInfo struct {
+		Name        role         `json:"name"`
+		Permissions []permission `json:"permissions"`
+		TeamScoped  bool         `json:"teamScoped"`
+	}
+
+	roles := make([]roleInfo, 0, len(allRoles))
+	for _, name := range allRoles {
+		roles = append(roles, roleInfo{name, rolePermissions[name], teamScopedRoles[name]})
+	}
+
+	js, _ := json.Marshal(roles)
+	w.Write([]byte(js))
+}
+
+func (env *env) usersSetRoles(w http.ResponseWriter, r *http.Request) {
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	roles, err := parseRoles(r.Form.Get("roles"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	u, err := getUser(env.db, uid)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	// there has to be someone left who can give out roles
+	isAdmin := false
+	for _, r := range roles {
+		isAdmin = isAdmin || r == roleAdmin
+	}
+	if !isAdmin {
+		last, err := isLastAdmin(env.db, u)
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, ""))
+			do500(w)
+			return
+		}
+		if last {
+			do409(w)
+			return
+		}
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		err = setRoles(tx, uid, roles)
+		return auditEntry{auditUserRoles, uid, userTarget(uid), u.Roles, roles}, err
+	})
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
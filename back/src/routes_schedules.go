@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AndrewBurian/powermux"
+	"github.com/palantir/stacktrace"
+)
+
+// writeSchedules writes the user's schedules along with the one for today in their time zone
+func (env *env) writeSchedules(w http.ResponseWriter, uid uidT) {
+	loc, err := getUserLocation(env.db, uid, env.loc)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	current, err := getScheduleForDay(env.db, uid, time.Now().In(loc))
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to get current schedule"))
+		do500(w)
+		return
+	}
+
+	schedules, err := listSchedules(env.db, uid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to list schedules"))
+		do500(w)
+		return
+	}
+
+	if schedules == nil { // empty list
+		schedules = make([]schedule, 0) // doesn't marshal to null
+	}
+
+	js, _ := json.Marshal(struct {
+		Current   schedule   `json:"current"`
+		Schedules []schedule `json:"schedules"`
+	}{current, schedules})
+	w.Write([]byte(js))
+}
+
+func (env *env) schedulesOwn(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	env.writeSchedules(w, uid)
+}
+
+func (env *env) schedulesList(w http.ResponseWriter, r *http.Request) {
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	env.writeSchedules(w, uid)
+}
+
+func (env *env) schedulesSet(w http.ResponseWriter, r *http.Request) {
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	s := schedule{EffectiveFrom: r.Form.Get("effectiveFrom")}
+	_, err = time.Parse(dateLayout, s.EffectiveFrom)
+	if err != nil {
+		do400(w)
+		return
+	}
+	for i, name := range weekdayNames {
+		strExpected := r.Form.Get(name)
+		if strExpected == "" {
+			continue // a day off
+		}
+		s.Expected[i], err = strconv.Atoi(strExpected)
+		if err != nil || s.Expected[i] < 0 || s.Expected[i] > 24*60*60 {
+			do400(w)
+			return
+		}
+	}
+
+	_, err = uidToEmail(env.db, uid)
+	if err == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to find user"))
+		do500(w)
+		return
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		err = setSchedule(tx, uid, s)
+		return auditEntry{auditScheduleSet, uid, "schedule:" + strconv.Itoa(int(uid)) + ":" + s.EffectiveFrom, nil, s}, err
+	})
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) schedulesDelete(w http.ResponseWriter, r *http.Request) {
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	from := powermux.PathParam(r, "from")
+	_, err = time.Parse(dateLayout, from)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	schedules, err := listSchedules(env.db, uid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	var before interface{}
+	for _, s := range schedules {
+		if s.EffectiveFrom == from {
+			before = s
+		}
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		err = deleteSchedule(tx, uid, from)
+		return auditEntry{auditScheduleDelete, uid, "schedule:" + strconv.Itoa(int(uid)) + ":" + from, before, nil}, err
+	})
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
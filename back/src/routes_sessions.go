@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/AndrewBurian/powermux"
+	"github.com/palantir/stacktrace"
+)
+
+func writeSessions(w http.ResponseWriter, sessions []sessionInfo) {
+	if sessions == nil { // empty list
+		sessions = make([]sessionInfo, 0) // doesn't marshal to null
+	}
+
+	js, _ := json.Marshal(sessions)
+	w.Write([]byte(js))
+}
+
+func (env *env) logout(w http.ResponseWriter, r *http.Request) {
+	sid, ok := r.Context().Value(sidKey).(sidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	err := deleteSession(env.db, sid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) sessionsOwn(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+	sid, ok := r.Context().Value(sidKey).(sidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	sessions, err := listSessions(env.db, uid, sid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	writeSessions(w, sessions)
+}
+
+func (env *env) sessionsRevoke(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	id, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		found, err := deleteSessionByID(tx, uid, sessionIDT(id))
+		if err == nil && !found {
+			err = sql.ErrNoRows
+		}
+		return auditEntry{auditSessionRevoke, uid, "session:" + strconv.Itoa(id), nil, nil}, err
+	})
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) sessionsRevokeOthers(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+	sid, ok := r.Context().Value(sidKey).(sidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	err := env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		err = deleteOtherSessions(tx, uid, sid)
+		return auditEntry{auditSessionRevoke, uid, userTarget(uid), nil, map[string]interface{}{"kept": "current"}}, err
+	})
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to delete other sessions"))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) sessionsList(w http.ResponseWriter, r *http.Request) {
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	sessions, err := listSessions(env.db, uid, "")
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	writeSessions(w, sessions)
+}
+
+func (env *env) sessionsRevokeAll(w http.ResponseWriter, r *http.Request) {
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		err = deleteSessions(tx, uid)
+		return auditEntry{auditSessionRevoke, uid, userTarget(uid), nil, nil}, err
+	})
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to delete sessions"))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) sessionsRevokeUser(w http.ResponseWriter, r *http.Request) {
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	id, err := strconv.Atoi(powermux.PathParam(r, "session"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		found, err := deleteSessionByID(tx, uid, sessionIDT(id))
+		if err == nil && !found {
+			err = sql.ErrNoRows
+		}
+		return auditEntry{auditSessionRevoke, uid, "session:" + strconv.Itoa(id), nil, nil}, err
+	})
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AndrewBurian/powermux"
+	"github.com/palantir/stacktrace"
+)
+
+// pathTeamID parses the :id path parameter of /a/teams/:id routes
+func pathTeamID(r *http.Request) (id teamIDT, err error) {
+	intID, err := strconv.Atoi(powermux.PathParam(r, "id"))
+	return teamIDT(intID), err
+}
+
+// formTeamID parses the optional team filter of list and count routes, 0 if there's none
+func formTeamID(r *http.Request) (id teamIDT, err error) {
+	err = r.ParseForm()
+	if err != nil {
+		return 0, err
+	}
+
+	strID := r.Form.Get("team")
+	if strID == "" {
+		return 0, nil
+	}
+	intID, err := strconv.Atoi(strID)
+	return teamIDT(intID), err
+}
+
+func writeTeams(w http.ResponseWriter, teams []team) {
+	if teams == nil { // empty list
+		teams = make([]team, 0) // doesn't marshal to null
+	}
+
+	js, _ := json.Marshal(teams)
+	w.Write([]byte(js))
+}
+
+func (env *env) teamsOwn(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	teams, err := listUserTeams(env.db, uid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	writeTeams(w, teams)
+}
+
+func (env *env) teamsList(w http.ResponseWriter, r *http.Request) {
+	teams, err := listTeams(env.db, managedBy(r))
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	writeTeams(w, teams)
+}
+
+// parseTeamForm reads the name and parent of a team, checking that the parent exists
+func (env *env) parseTeamForm(r *http.Request) (name string, parent teamIDT, ok bool) {
+	err := r.ParseForm()
+	if err != nil {
+		return "", 0, false
+	}
+
+	name = r.Form.Get("name")
+	if strParent := r.Form.Get("parent"); strParent != "" && strParent != "0" {
+		intParent, err := strconv.Atoi(strParent)
+		if err != nil {
+			return "", 0, false
+		}
+		parent = teamIDT(intParent)
+		_, err = getTeam(env.db, parent)
+		if err != nil {
+			return "", 0, false
+		}
+	}
+
+	return name, parent, true
+}
+
+func (env *env) teamsCreate(w http.ResponseWriter, r *http.Request) {
+	name, parent, ok := env.parseTeamForm(r)
+	if !ok || name == "" {
+		do400(w)
+		return
+	}
+
+	var id teamIDT
+	err := env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		id, err = createTeam(tx, name, parent)
+		return auditEntry{auditTeamCreate, 0, teamTarget(id), nil, team{ID: id, Name: name, Parent: parent}}, err
+	})
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		ID teamIDT `json:"id"`
+	}{id})
+	w.Write([]byte(js))
+}
+
+func (env *env) teamsGet(w http.ResponseWriter, r *http.Request) {
+	id, err := pathTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	info := struct {
+		team
+		Members []teamMember `json:"members"`
+	}{}
+
+	info.team, err = getTeam(env.db, id)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	info.Members, err = listTeamMembers(env.db, id)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if info.Members == nil { // empty list
+		info.Members = make([]teamMember, 0) // doesn't marshal to null
+	}
+
+	js, _ := json.Marshal(info)
+	w.Write([]byte(js))
+}
+
+func (env *env) teamsUpdate(w http.ResponseWriter, r *http.Request) {
+	id, err := pathTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	t, err := getTeam(env.db, id)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	name, parent, ok := env.parseTeamForm(r)
+	if !ok {
+		do400(w)
+		return
+	}
+
+	// only the fields that were sent are changed
+	if name == "" {
+		name = t.Name
+	}
+	if _, sent := r.Form["parent"]; !sent {
+		parent = t.Parent
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		err = updateTeam(tx, id, name, parent)
+		return auditEntry{auditTeamUpdate, 0, teamTarget(id),
+			map[string]interface{}{"name": t.Name, "parent": t.Parent},
+			map[string]interface{}{"name": name, "parent": parent}}, err
+	})
+	if stacktrace.RootCause(err) == errTeamCycle {
+		do409(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) teamsDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := pathTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		before, err := getTeam(tx, id)
+		if err != nil {
+			return a, stacktrace.Propagate(err, "")
+		}
+		err = deleteTeam(tx, id)
+		return auditEntry{auditTeamDelete, 0, teamTarget(id), before, nil}, err
+	})
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if stacktrace.RootCause(err) == errTeamNotEmpty {
+		do409(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) teamsSetMember(w http.ResponseWriter, r *http.Request) {
+	id, err := pathTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+	uid, err := strconv.Atoi(powermux.PathParam(r, "member"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	_, err = getUser(env.db, uidT(uid))
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	manager := r.Form.Get("manager") == "1" || r.Form.Get("manager") == "true"
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		err = setTeamMember(tx, id, uidT(uid), manager)
+		return auditEntry{auditTeamMember, uidT(uid), teamTarget(id), nil, map[string]interface{}{"manager": manager}}, err
+	})
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) teamsRemoveMember(w http.ResponseWriter, r *http.Request) {
+	id, err := pathTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+	uid, err := strconv.Atoi(powermux.PathParam(r, "member"))
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	members, err := listTeamMembers(env.db, id)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	var before interface{}
+	for _, m := range members {
+		if m.UID == uidT(uid) {
+			before = map[string]interface{}{"manager": m.Manager}
+		}
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		found, err := removeTeamMember(tx, id, uidT(uid))
+		if err == nil && !found {
+			err = sql.ErrNoRows
+		}
+		return auditEntry{auditTeamMember, uidT(uid), teamTarget(id), before, nil}, err
+	})
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) teamsOnline(w http.ResponseWriter, r *http.Request) {
+	id, err := pathTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	onlineUsers, err := listOnlineUsers(env.db, 0, id)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to list online users"))
+		do500(w)
+		return
+	}
+
+	if onlineUsers == nil { // empty list
+		onlineUsers = make([]onlineUser, 0) // doesn't marshal to null
+	}
+
+	js, _ := json.Marshal(onlineUsers)
+	w.Write([]byte(js))
+}
+
+// teamsBalances sums up how far ahead or behind everyone in the team and its subteams is
+func (env *env) teamsBalances(w http.ResponseWriter, r *http.Request) {
+	id, err := pathTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	uids, err := listTeamUIDs(env.db, id)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	type balance struct {
+		UID           uidT `json:"uid"`
+		DeltaForMonth int  `json:"deltaForMonth"`
+		DeltaForDay   int  `json:"deltaForDay"`
+	}
+	summary := struct {
+		Users         []balance `json:"users"`
+		DeltaForMonth int       `json:"deltaForMonth"`
+		DeltaForDay   int       `json:"deltaForDay"`
+	}{Users: make([]balance, 0, len(uids))}
+
+	now := time.Now()
+	for _, uid := range uids {
+		b := balance{UID: uid}
+		loc, err := getUserLocation(env.db, uid, env.loc)
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, ""))
+			do500(w)
+			return
+		}
+		b.DeltaForMonth, err = getDeltaForMonth(env.db, uid, now.In(loc))
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to get monthly delta"))
+			do500(w)
+			return
+		}
+		b.DeltaForDay, err = getDeltaForDay(env.db, uid, now.In(loc))
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to get daily delta"))
+			do500(w)
+			return
+		}
+		summary.Users = append(summary.Users, b)
+		summary.DeltaForMonth += b.DeltaForMonth
+		summary.DeltaForDay += b.DeltaForDay
+	}
+
+	js, _ := json.Marshal(summary)
+	w.Write([]byte(js))
+}
+
+// teamsGetPolicy returns null if the team inherits its clock-out policy
+func (env *env) teamsGetPolicy(w http.ResponseWriter, r *http.Request) {
+	id, err := pathTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	p, err := getTeamPolicy(env.db, id)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(p)
+	w.Write([]byte(js))
+}
+
+// teamsSetPolicy takes kind, at for clockOut and hours for keepOpen, see clockOutPolicy
+func (env *env) teamsSetPolicy(w http.ResponseWriter, r *http.Request) {
+	id, err := pathTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	p := clockOutPolicy{Kind: r.Form.Get("kind"), At: r.Form.Get("at")}
+	if strHours := r.Form.Get("hours"); strHours != "" {
+		p.Hours, err = strconv.Atoi(strHours)
+		if err != nil {
+			do400(w)
+			return
+		}
+	}
+	if p.validate() != nil {
+		do400(w)
+		return
+	}
+
+	env.setPolicy(w, r, id, &p)
+}
+
+func (env *env) teamsInheritPolicy(w http.ResponseWriter, r *http.Request) {
+	id, err := pathTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	env.setPolicy(w, r, id, nil)
+}
+
+func (env *env) setPolicy(w http.ResponseWriter, r *http.Request, id teamIDT, p *clockOutPolicy) {
+	err := env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		before, err := getTeamPolicy(tx, id)
+		if err != nil {
+			return a, stacktrace.Propagate(err, "")
+		}
+
+		err = setTeamPolicy(tx, id, p)
+		// so that no policy is recorded as null rather than a null pointer
+		var jsBefore, jsAfter interface{}
+		if before != nil {
+			jsBefore = before
+		}
+		if p != nil {
+			jsAfter = p
+		}
+		return auditEntry{auditTeamPolicy, 0, teamTarget(id), jsBefore, jsAfter}, err
+	})
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+// teamsGetShifts returns whether the team's shifts count towards the day they start on, null if inherited
+func (env *env) teamsGetShifts(w http.ResponseWriter, r *http.Request) {
+	id, err := pathTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	whole, err := getTeamWholeShifts(env.db, id)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		WholeShifts *bool `json:"wholeShifts"`
+	}{whole})
+	w.Write([]byte(js))
+}
+
+// teamsSetShifts takes wholeShifts, leaving it out makes the team inherit the setting
+func (env *env) teamsSetShifts(w http.ResponseWriter, r *http.Request) {
+	id, err := pathTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	var whole *bool
+	if strWhole := r.Form.Get("wholeShifts"); strWhole != "" {
+		value, err := formBool(strWhole)
+		if err != nil {
+			do400(w)
+			return
+		}
+		whole = &value
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		before, err := getTeamWholeShifts(tx, id)
+		if err != nil {
+			return a, stacktrace.Propagate(err, "")
+		}
+
+		err = setTeamWholeShifts(tx, id, whole)
+		return auditEntry{auditTeamShifts, 0, teamTarget(id),
+			map[string]interface{}{"wholeShifts": before}, map[string]interface{}{"wholeShifts": whole}}, err
+	})
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) teamsGetTimeZone(w http.ResponseWriter, r *http.Request) {
+	id, err := pathTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	name, err := getTeamTimeZone(env.db, id)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		TimeZone string `json:"timeZone"` // empty if it's inherited
+	}{name})
+	w.Write([]byte(js))
+}
+
+// teamsSetTimeZone takes timeZone, like Europe/Vienna, leaving it out makes the team inherit it
+func (env *env) teamsSetTimeZone(w http.ResponseWriter, r *http.Request) {
+	id, err := pathTeamID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	name := r.Form.Get("timeZone")
+	if name != "" {
+		_, err = loadTimeZone(name)
+		if err != nil {
+			do400(w)
+			return
+		}
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		before, err := getTeamTimeZone(tx, id)
+		if err != nil {
+			return a, stacktrace.Propagate(err, "")
+		}
+
+		err = setTeamTimeZone(tx, id, name)
+		return auditEntry{auditTeamTimeZone, 0, teamTarget(id),
+			map[string]interface{}{"timeZone": before}, map[string]interface{}{"timeZone": name}}, err
+	})
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AndrewBurian/powermux"
+	"github.com/palantir/stacktrace"
+)
+
+func (env *env) lockoutsList(w http.ResponseWriter, r *http.Request) {
+	throttles, err := listThrottles(env.db)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	if throttles == nil { // empty list
+		throttles = make([]throttle, 0) // doesn't marshal to null
+	}
+
+	js, _ := json.Marshal(throttles)
+	w.Write([]byte(js))
+}
+
+func (env *env) lockoutsClearUser(w http.ResponseWriter, r *http.Request) {
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	email, err := uidToEmail(env.db, uid)
+	if err == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	err = clearUserThrottle(env.db, uid)
+	if err == nil {
+		err = clearThrottle(env.db, throttleEmail, emailThrottleKey(email))
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) lockoutsClearIP(w http.ResponseWriter, r *http.Request) {
+	err := clearThrottle(env.db, throttleIP, powermux.PathParam(r, "ip"))
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) loginsList(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	uid, from, to, limit := 0, 0, int(time.Now().Unix())+1, 100
+	for name, x := range map[string]*int{"uid": &uid, "from": &from, "to": &to, "limit": &limit} {
+		if str := r.Form.Get(name); str != "" {
+			*x, err = strconv.Atoi(str)
+			if err != nil {
+				do400(w)
+				return
+			}
+		}
+	}
+	if limit < 1 || limit > 1000 {
+		do400(w)
+		return
+	}
+
+	attempts, err := listLoginAttempts(env.db, uidT(uid), r.Form.Get("ip"), from, to, limit)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	if attempts == nil { // empty list
+		attempts = make([]loginAttempt, 0) // doesn't marshal to null
+	}
+
+	js, _ := json.Marshal(attempts)
+	w.Write([]byte(js))
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/palantir/stacktrace"
+)
+
+func (env *env) authorizeTOTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		do500(w)
+		return
+	}
+
+	type form struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	f := form{}
+	json.Unmarshal(body, &f)
+
+	uid, err := getChallengeUser(env.db, f.Challenge)
+	if stacktrace.RootCause(err) == errInvalidToken {
+		do401(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	// guessing codes is throttled the same way as guessing passwords
+	wait, err := checkThrottle(env.db, throttleUser, strconv.Itoa(int(uid)))
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to check user throttle"))
+		do500(w)
+		return
+	}
+	if wait > 0 {
+		do429(w, wait)
+		return
+	}
+
+	email, err := uidToEmail(env.db, uid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	err = checkSecondFactor(env.db, uid, f.Code)
+	if err != nil && stacktrace.RootCause(err) != errWrongCode {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	ok := err == nil
+
+	err = recordLoginAttempt(env.db, email, uid, env.clientIP(r), ok)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+	}
+	if !ok {
+		err = recordFailure(env.db, throttleUser, strconv.Itoa(int(uid)), env.conf.Login)
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, ""))
+		}
+		do401(w)
+		return
+	}
+
+	err = clearUserThrottle(env.db, uid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+	}
+
+	err = deleteChallenge(env.db, f.Challenge)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	env.startSession(w, r, uid)
+}
+
+func (env *env) totpStatus(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	enabled, required, err := getTOTPStatus(env.db, uid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		Enabled  bool `json:"enabled"`
+		Required bool `json:"required"`
+	}{enabled, required})
+	w.Write([]byte(js))
+}
+
+func (env *env) totpBegin(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	email, err := uidToEmail(env.db, uid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	secret, err := beginTOTPEnrollment(env.db, uid)
+	if stacktrace.RootCause(err) == errTOTPEnabled {
+		do409(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"` // to be shown as a QR code
+	}{secret, totpURI(email, secret)})
+	w.Write([]byte(js))
+}
+
+func (env *env) totpConfirm(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	codes, err := confirmTOTPEnrollment(env.db, uid, r.Form.Get("code"))
+	switch stacktrace.RootCause(err) {
+	case nil:
+	case errWrongCode:
+		do401(w)
+		return
+	case errTOTPEnabled, errTOTPNotEnabled:
+		do409(w)
+		return
+	default:
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}{codes})
+	w.Write([]byte(js))
+}
+
+func (env *env) totpDisable(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	_, required, err := getTOTPStatus(env.db, uid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if required {
+		do403(w)
+		return
+	}
+
+	if ok, _ := checkPassword(env.db, uid, r.Form.Get("password")); !ok {
+		do401(w)
+		return
+	}
+	err = checkSecondFactor(env.db, uid, r.Form.Get("code"))
+	switch stacktrace.RootCause(err) {
+	case nil:
+	case errWrongCode:
+		do401(w)
+		return
+	case errTOTPNotEnabled:
+		do409(w)
+		return
+	default:
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	err = disableTOTP(env.db, uid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) totpRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = checkSecondFactor(env.db, uid, r.Form.Get("code"))
+	switch stacktrace.RootCause(err) {
+	case nil:
+	case errWrongCode:
+		do401(w)
+		return
+	case errTOTPNotEnabled:
+		do409(w)
+		return
+	default:
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	codes, err := regenerateRecoveryCodes(env.db, uid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}{codes})
+	w.Write([]byte(js))
+}
+
+func (env *env) totpRequire(w http.ResponseWriter, r *http.Request) {
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	_, err = uidToEmail(env.db, uid)
+	if err == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	_, wasRequired, err := getTOTPStatus(env.db, uid)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	required := r.Form.Get("required") == "1" || r.Form.Get("required") == "true"
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		err = setTOTPRequired(tx, uid, required)
+		return auditEntry{auditUserTOTP, uid, userTarget(uid),
+			map[string]interface{}{"required": wasRequired}, map[string]interface{}{"required": required}}, err
+	})
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+// totpReset is for users who lost their device and recovery codes
+func (env *env) totpReset(w http.ResponseWriter, r *http.Request) {
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	wasEnabled, _, err := getTOTPStatus(env.db, uid)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		err = disableTOTP(tx, uid)
+		return auditEntry{auditUserTOTP, uid, userTarget(uid),
+			map[string]interface{}{"enabled": wasEnabled}, map[string]interface{}{"enabled": false}}, err
+	})
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
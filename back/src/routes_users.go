@@ -0,0 +1,478 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+func validEmail(email string) bool {
+	at := strings.Index(email, "@")
+	return at > 0 && at < len(email)-1 && !strings.ContainsAny(email, " \t\r\n")
+}
+
+func (env *env) usersList(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	page, perPage := 1, 50
+	if strPage := r.Form.Get("page"); strPage != "" {
+		page, err = strconv.Atoi(strPage)
+		if err != nil || page < 1 {
+			do400(w)
+			return
+		}
+	}
+	if strPerPage := r.Form.Get("perPage"); strPerPage != "" {
+		perPage, err = strconv.Atoi(strPerPage)
+		if err != nil || perPage < 1 || perPage > 500 {
+			do400(w)
+			return
+		}
+	}
+
+	users, total, err := listUsers(env.db, managedBy(r), perPage, (page-1)*perPage)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to list users"))
+		do500(w)
+		return
+	}
+
+	if users == nil { // empty list
+		users = make([]userInfo, 0) // doesn't marshal to null
+	}
+
+	js, _ := json.Marshal(struct {
+		Users   []userInfo `json:"users"`
+		Total   int        `json:"total"`
+		Page    int        `json:"page"`
+		PerPage int        `json:"perPage"`
+	}{users, total, page, perPage})
+	w.Write([]byte(js))
+}
+
+func (env *env) usersCreate(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	email := r.Form.Get("email")
+	password := r.Form.Get("password")
+	if !validEmail(email) || password == "" {
+		do400(w)
+		return
+	}
+
+	_, err = emailToUID(env.db, email)
+	if err == nil {
+		do409(w)
+		return
+	}
+
+	skipVerification := r.Form.Get("skipVerification") == "1" || r.Form.Get("skipVerification") == "true"
+	var uid uidT
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		uid, err = insertUser(tx, email, password, []role{roleEmployee}, skipVerification, env.conf.PasswordHash)
+		return auditEntry{auditUserCreate, uid, userTarget(uid), nil, map[string]interface{}{"email": email}}, err
+	})
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to create user"))
+		do500(w)
+		return
+	}
+	if !skipVerification {
+		env.sendConfirmation(uid, email)
+	}
+
+	js, _ := json.Marshal(struct {
+		UID uidT `json:"uid"`
+	}{uid})
+	w.Write([]byte(js))
+}
+
+func (env *env) usersGet(w http.ResponseWriter, r *http.Request) {
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	info := struct {
+		userInfo
+		DeltaForMonth int `json:"deltaForMonth"`
+		DeltaForDay   int `json:"deltaForDay"`
+		Balance       int `json:"balance"`
+	}{}
+
+	info.userInfo, err = getUser(env.db, uid)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	loc, err := getUserLocation(env.db, uid, env.loc)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	info.DeltaForMonth, err = getDeltaForMonth(env.db, uid, time.Now().In(loc))
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to get monthly delta"))
+		do500(w)
+		return
+	}
+
+	info.DeltaForDay, err = getDeltaForDay(env.db, uid, time.Now().In(loc))
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to get daily delta"))
+		do500(w)
+		return
+	}
+
+	info.Balance, err = getBalance(env.db, uid, time.Now().In(loc), env.conf.OvertimePolicy)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to get balance"))
+		do500(w)
+		return
+	}
+
+	js, _ := json.Marshal(info)
+	w.Write([]byte(js))
+}
+
+// checkCredentialChange writes a response and returns false unless the actor may change the target's
+// password, email or whether they're active, see holdsPermissionsOf, and deactivating them leaves an admin
+func (env *env) checkCredentialChange(w http.ResponseWriter, actor uidT, u userInfo, deactivate bool) (ok bool) {
+	holds, err := holdsPermissionsOf(env.db, actor, u.UID)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return false
+	}
+	if !holds {
+		do403(w)
+		return false
+	}
+
+	if deactivate {
+		last, err := isLastAdmin(env.db, u)
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, ""))
+			do500(w)
+			return false
+		}
+		if last {
+			do409(w)
+			return false
+		}
+	}
+	return true
+}
+
+func (env *env) usersUpdate(w http.ResponseWriter, r *http.Request) {
+	actor, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	u, err := getUser(env.db, uid)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	// checked before anything is changed, the empty string makes the user inherit it again
+	timeZone, changeTimeZone := r.Form["timeZone"]
+	if changeTimeZone && timeZone[0] != "" {
+		_, err = loadTimeZone(timeZone[0])
+		if err != nil {
+			do400(w)
+			return
+		}
+	}
+
+	// the empty string makes the start date that of the user's first entry again
+	startDate, changeStart := r.Form["startDate"]
+	if changeStart && startDate[0] != "" {
+		_, err = time.Parse(dateLayout, startDate[0])
+		if err != nil {
+			do400(w)
+			return
+		}
+	}
+
+	strActive := r.Form.Get("active")
+	active := strActive == "1" || strActive == "true"
+	if r.Form.Get("email") != "" || strActive != "" {
+		if !env.checkCredentialChange(w, actor, u, strActive != "" && !active) {
+			return
+		}
+	}
+
+	// only the fields that were sent are changed
+	if email := r.Form.Get("email"); email != "" {
+		if !validEmail(email) {
+			do400(w)
+			return
+		}
+		existing, err := emailToUID(env.db, email)
+		if err == nil && existing != uid {
+			do409(w)
+			return
+		}
+		before := map[string]interface{}{"email": u.Email}
+		if r.Form.Get("skipVerification") == "1" || r.Form.Get("skipVerification") == "true" {
+			err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+				err = setEmail(tx, uid, email)
+				return auditEntry{auditUserEmail, uid, userTarget(uid), before, map[string]interface{}{"email": email}}, err
+			})
+		} else if existing != uid {
+			err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+				err = requestEmailChange(tx, uid, email)
+				return auditEntry{auditUserEmail, uid, userTarget(uid), before, map[string]interface{}{"pendingEmail": email}}, err
+			})
+			if err == nil {
+				env.sendConfirmation(uid, email)
+			}
+		}
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, ""))
+			do500(w)
+			return
+		}
+	}
+
+	if strActive != "" {
+		if !active {
+			err = clockOut(env.db, uid, actor)
+		}
+		if err == nil {
+			err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+				if active {
+					err = reactivateUser(tx, uid)
+				} else {
+					err = deactivateUser(tx, uid)
+				}
+				return auditEntry{auditUserActive, uid, userTarget(uid),
+					map[string]interface{}{"active": u.Active}, map[string]interface{}{"active": active}}, err
+			})
+		}
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, ""))
+			do500(w)
+			return
+		}
+	}
+
+	if changeTimeZone {
+		err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+			err = setUserTimeZone(tx, uid, timeZone[0])
+			return auditEntry{auditUserTimeZone, uid, userTarget(uid),
+				map[string]interface{}{"timeZone": u.TimeZone}, map[string]interface{}{"timeZone": timeZone[0]}}, err
+		})
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, ""))
+			do500(w)
+			return
+		}
+	}
+
+	if changeStart {
+		err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+			err = setUserBalanceStart(tx, uid, startDate[0])
+			return auditEntry{auditUserBalance, uid, userTarget(uid),
+				map[string]interface{}{"startDate": u.StartDate}, map[string]interface{}{"startDate": startDate[0]}}, err
+		})
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, ""))
+			do500(w)
+			return
+		}
+	}
+}
+
+func (env *env) usersDeactivate(w http.ResponseWriter, r *http.Request) {
+	actor, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	u, err := getUser(env.db, uid)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+
+	if !env.checkCredentialChange(w, actor, u, true) {
+		return
+	}
+
+	err = clockOut(env.db, uid, actor)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to clock out"))
+		do500(w)
+		return
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		err = deactivateUser(tx, uid)
+		return auditEntry{auditUserActive, uid, userTarget(uid),
+			map[string]interface{}{"active": u.Active}, map[string]interface{}{"active": false}}, err
+	})
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) usersResetPassword(w http.ResponseWriter, r *http.Request) {
+	actor, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	password := r.Form.Get("password")
+	if password == "" {
+		do400(w)
+		return
+	}
+
+	u, err := getUser(env.db, uid)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !env.checkCredentialChange(w, actor, u, false) {
+		return
+	}
+
+	err = env.audited(r, func(tx *sql.Tx) (a auditEntry, err error) {
+		err = setPassword(tx, uid, password, env.conf.PasswordHash)
+		if err != nil {
+			return a, stacktrace.Propagate(err, "")
+		}
+		err = deleteSessions(tx, uid)
+		return auditEntry{auditUserPassword, uid, userTarget(uid), nil, nil}, stacktrace.Propagate(err, "failed to delete sessions")
+	})
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+// usersClockIn and usersClockOut are meant for shared devices that clock in whoever is using them
+func (env *env) usersClockIn(w http.ResponseWriter, r *http.Request) {
+	env.usersClock(w, r, clockIn)
+}
+
+func (env *env) usersClockOut(w http.ResponseWriter, r *http.Request) {
+	env.usersClock(w, r, clockOut)
+}
+
+func (env *env) usersClock(w http.ResponseWriter, r *http.Request, clock func(db *sql.DB, uid, actor uidT) error) {
+	actor, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	uid, err := pathUID(r)
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	u, err := getUser(env.db, uid)
+	if stacktrace.RootCause(err) == sql.ErrNoRows {
+		do404(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	if !u.Active {
+		do409(w)
+		return
+	}
+
+	err = clock(env.db, uid, actor)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to clock"))
+		do500(w)
+		return
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/palantir/stacktrace"
+)
+
+func (env *env) confirm(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		do500(w)
+		return
+	}
+
+	type form struct {
+		Token string `json:"token"`
+	}
+	f := form{}
+	json.Unmarshal(body, &f)
+
+	uid, email, err := parseConfirmation(env.conf.Secret, f.Token)
+	if err != nil {
+		do401(w)
+		return
+	}
+
+	err = confirmEmail(env.db, uid, email)
+	if stacktrace.RootCause(err) == errInvalidToken {
+		do401(w)
+		return
+	}
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+}
+
+func (env *env) confirmResend(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		do500(w)
+		return
+	}
+
+	type form struct {
+		Email string `json:"email"`
+	}
+	f := form{}
+	json.Unmarshal(body, &f)
+
+	// see passwordResetRequest
+	uid, err := emailToUID(env.db, f.Email)
+	if err != nil {
+		return
+	}
+	verified, err := checkVerified(env.db, uid)
+	if err != nil || verified {
+		return
+	}
+
+	env.sendConfirmation(uid, f.Email)
+}
+
+func (env *env) emailChange(w http.ResponseWriter, r *http.Request) {
+	uid, ok := r.Context().Value(uidKey).(uidT)
+	if !ok {
+		fmt.Println(stacktrace.NewError("malformed context"))
+		do500(w)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		do400(w)
+		return
+	}
+
+	email := r.Form.Get("email")
+	if !validEmail(email) {
+		do400(w)
+		return
+	}
+
+	if ok, _ := checkPassword(env.db, uid, r.Form.Get("password")); !ok {
+		do401(w)
+		return
+	}
+
+	_, err = emailToUID(env.db, email)
+	if err == nil {
+		do409(w)
+		return
+	}
+
+	err = requestEmailChange(env.db, uid, email)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, ""))
+		do500(w)
+		return
+	}
+	env.sendConfirmation(uid, email)
+}
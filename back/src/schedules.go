@@ -0,0 +1,76 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+type schedule struct {
+	EffectiveFrom string `json:"effectiveFrom"`
+	Expected      [7]int `json:"expected"` // seconds, indexed by time.Weekday so Sunday comes first
+}
+
+// defaultSchedule applies to users who have no schedule for a given date
+var defaultSchedule = schedule{
+	EffectiveFrom: "0001-01-01",
+	Expected:      [7]int{0, 8 * 60 * 60, 8 * 60 * 60, 8 * 60 * 60, 8 * 60 * 60, 8 * 60 * 60, 0},
+}
+
+var weekdayNames = [7]string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+// getScheduleForDay returns the schedule for the date in its location
+func getScheduleForDay(db *sql.DB, uid uidT, date time.Time) (s schedule, err error) {
+	err = db.QueryRow(
+		`SELECT effective_from, sunday_s, monday_s, tuesday_s, wednesday_s, thursday_s, friday_s, saturday_s
+			FROM schedules WHERE uid = ?1 AND effective_from <= ?2
+			ORDER BY effective_from DESC LIMIT 1`, uid, date.Format(dateLayout)).Scan(
+		&s.EffectiveFrom, &s.Expected[0], &s.Expected[1], &s.Expected[2], &s.Expected[3], &s.Expected[4], &s.Expected[5], &s.Expected[6])
+	if err == sql.ErrNoRows {
+		return defaultSchedule, nil
+	}
+	return s, stacktrace.Propagate(err, "failed to get schedule")
+}
+
+func listSchedules(db *sql.DB, uid uidT) (schedules []schedule, err error) {
+	rows, err := db.Query(
+		`SELECT effective_from, sunday_s, monday_s, tuesday_s, wednesday_s, thursday_s, friday_s, saturday_s
+			FROM schedules WHERE uid = ? ORDER BY effective_from`, uid)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list schedules")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s schedule
+		err = rows.Scan(&s.EffectiveFrom, &s.Expected[0], &s.Expected[1], &s.Expected[2], &s.Expected[3], &s.Expected[4], &s.Expected[5], &s.Expected[6])
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		schedules = append(schedules, s)
+	}
+
+	return schedules, nil
+}
+
+// setSchedule adds a schedule starting on s.EffectiveFrom, replacing one
+// that starts on the same day, earlier days keep using the previous schedule
+func setSchedule(db execer, uid uidT, s schedule) (err error) {
+	_, err = time.Parse(dateLayout, s.EffectiveFrom)
+	if err != nil {
+		return stacktrace.Propagate(err, "malformed date")
+	}
+
+	_, err = db.Exec(
+		`INSERT OR REPLACE INTO schedules
+			(uid, effective_from, sunday_s, monday_s, tuesday_s, wednesday_s, thursday_s, friday_s, saturday_s)
+			VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9)`,
+		uid, s.EffectiveFrom, s.Expected[0], s.Expected[1], s.Expected[2], s.Expected[3], s.Expected[4], s.Expected[5], s.Expected[6])
+	return stacktrace.Propagate(err, "failed to set schedule")
+}
+
+func deleteSchedule(db execer, uid uidT, effectiveFrom string) (err error) {
+	_, err = db.Exec("DELETE FROM schedules WHERE uid = ?1 AND effective_from = ?2", uid, effectiveFrom)
+	return stacktrace.Propagate(err, "failed to delete schedule")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+type sessionIDT int
+
+type sessionInfo struct {
+	ID        sessionIDT `json:"id"`
+	CreatedAt int        `json:"createdAt"` // 0 if unknown
+	LastUsed  int        `json:"lastUsed"`  // see above
+	Expires   int        `json:"expires"`
+	IP        string     `json:"ip"`
+	UserAgent string     `json:"userAgent"`
+	Current   bool       `json:"current"`
+}
+
+// listSessions lists the user's unexpired sessions, marking the one with the given sid as current
+func listSessions(db *sql.DB, uid uidT, current sidT) (sessions []sessionInfo, err error) {
+	rows, err := db.Query(
+		`SELECT session_id, sid, COALESCE(created_unix_s, 0), COALESCE(last_used_unix_s, 0),
+			expires_unix_s, COALESCE(ip, ''), COALESCE(user_agent, '')
+			FROM sessions WHERE uid = ?1 AND expires_unix_s >= ?2
+			ORDER BY last_used_unix_s DESC`, uid, time.Now().Unix())
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list sessions")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s sessionInfo
+		var hash string
+		err = rows.Scan(&s.ID, &hash, &s.CreatedAt, &s.LastUsed, &s.Expires, &s.IP, &s.UserAgent)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		s.Current = hash == hashToken(string(current))
+		sessions = append(sessions, s)
+	}
+
+	return sessions, nil
+}
+
+// touchSession pushes the expiry of the session back by idle, but no further than absolute after it was created,
+// sessions created before that was recorded are never extended past their original expiry
+func touchSession(db *sql.DB, sid sidT, absolute, idle time.Duration) (err error) {
+	now := time.Now()
+	_, err = db.Exec(
+		`UPDATE sessions SET last_used_unix_s = ?1,
+			expires_unix_s = MIN(?2, COALESCE(created_unix_s + ?3, expires_unix_s))
+			WHERE sid = ?4`, now.Unix(), now.Add(idle).Unix(), int64(absolute.Seconds()), hashToken(string(sid)))
+	return stacktrace.Propagate(err, "failed to update session")
+}
+
+func deleteSession(db *sql.DB, sid sidT) (err error) {
+	_, err = db.Exec("DELETE FROM sessions WHERE sid = ?", hashToken(string(sid)))
+	return stacktrace.Propagate(err, "failed to delete session")
+}
+
+// deleteSessionByID only deletes the session if it belongs to the given user
+func deleteSessionByID(db execer, uid uidT, id sessionIDT) (found bool, err error) {
+	res, err := db.Exec("DELETE FROM sessions WHERE session_id = ?1 AND uid = ?2", id, uid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to delete session")
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, stacktrace.Propagate(err, "failed to get affected rows")
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/palantir/stacktrace"
+)
+
+type teamIDT int
+
+type team struct {
+	ID     teamIDT `json:"id"`
+	Name   string  `json:"name"`
+	Parent teamIDT `json:"parent"` // 0 for top level teams
+	Size   int     `json:"size"`   // direct members only
+}
+
+type teamMember struct {
+	UID     uidT   `json:"uid"`
+	Email   string `json:"email"`
+	Manager bool   `json:"manager"`
+}
+
+var (
+	errTeamCycle    = errors.New("a team can't be inside itself")
+	errTeamNotEmpty = errors.New("team has subteams")
+)
+
+// teams are nested through parent_id, team_descendants pairs every team with itself and all teams below it
+
+const teamColumns = `teams.team_id, name, COALESCE(parent_id, 0),
+	(SELECT COUNT(*) FROM team_members WHERE team_members.team_id = teams.team_id)`
+
+func scanTeams(rows *sql.Rows) (teams []team, err error) {
+	defer rows.Close()
+
+	for rows.Next() {
+		var t team
+		err = rows.Scan(&t.ID, &t.Name, &t.Parent, &t.Size)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		teams = append(teams, t)
+	}
+
+	return teams, nil
+}
+
+// listTeams lists only the teams the manager manages and the ones below them unless managedBy is 0
+func listTeams(db *sql.DB, managedBy uidT) (teams []team, err error) {
+	rows, err := db.Query(
+		`SELECT `+teamColumns+` FROM teams
+			WHERE ?1 = 0 OR team_id IN (SELECT team_descendants.team_id
+				FROM team_members JOIN team_descendants ON team_members.team_id = ancestor_id
+				WHERE uid = ?1 AND manager = 1)
+			ORDER BY name`, managedBy)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list teams")
+	}
+	return scanTeams(rows)
+}
+
+// listUserTeams lists the teams the user is a direct member of
+func listUserTeams(db *sql.DB, uid uidT) (teams []team, err error) {
+	rows, err := db.Query(
+		`SELECT `+teamColumns+` FROM teams
+			WHERE team_id IN (SELECT team_id FROM team_members WHERE uid = ?)
+			ORDER BY name`, uid)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list teams")
+	}
+	return scanTeams(rows)
+}
+
+func getTeam(db execer, id teamIDT) (t team, err error) {
+	err = db.QueryRow(`SELECT `+teamColumns+` FROM teams WHERE team_id = ?`, id).Scan(&t.ID, &t.Name, &t.Parent, &t.Size)
+	return t, stacktrace.Propagate(err, "failed to get team")
+}
+
+func nullableTeam(id teamIDT) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+func createTeam(db execer, name string, parent teamIDT) (id teamIDT, err error) {
+	res, err := db.Exec("INSERT INTO teams (name, parent_id) VALUES (?1, ?2)", name, nullableTeam(parent))
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to create team")
+	}
+
+	lastID, err := res.LastInsertId()
+	return teamIDT(lastID), stacktrace.Propagate(err, "failed to get team id")
+}
+
+func updateTeam(db execer, id teamIDT, name string, parent teamIDT) (err error) {
+	if parent != 0 {
+		var inside bool
+		err = db.QueryRow(
+			"SELECT COUNT(*) > 0 FROM team_descendants WHERE ancestor_id = ?1 AND team_id = ?2", id, parent).Scan(&inside)
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to check for cycles")
+		}
+		if inside {
+			return stacktrace.Propagate(errTeamCycle, "")
+		}
+	}
+
+	_, err = db.Exec("UPDATE teams SET name = ?1, parent_id = ?2 WHERE team_id = ?3", name, nullableTeam(parent), id)
+	return stacktrace.Propagate(err, "failed to update team")
+}
+
+// deleteTeam removes the team along with its memberships, which is why it has to be done in a transaction,
+// teams with subteams can't be deleted
+func deleteTeam(tx *sql.Tx, id teamIDT) (err error) {
+	var children int
+	err = tx.QueryRow("SELECT COUNT(*) FROM teams WHERE parent_id = ?", id).Scan(&children)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to count subteams")
+	}
+	if children > 0 {
+		return stacktrace.Propagate(errTeamNotEmpty, "")
+	}
+
+	_, err = tx.Exec("DELETE FROM team_members WHERE team_id = ?", id)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to delete members")
+	}
+
+	_, err = tx.Exec("DELETE FROM teams WHERE team_id = ?", id)
+	return stacktrace.Propagate(err, "failed to delete team")
+}
+
+// listTeamMembers lists the direct members of the team, without the ones of its subteams
+func listTeamMembers(db *sql.DB, id teamIDT) (members []teamMember, err error) {
+	rows, err := db.Query(
+		`SELECT users.uid, email, manager FROM team_members JOIN users ON team_members.uid = users.uid
+			WHERE team_id = ? ORDER BY email`, id)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list members")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m teamMember
+		err = rows.Scan(&m.UID, &m.Email, &m.Manager)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		members = append(members, m)
+	}
+
+	return members, nil
+}
+
+// setTeamMember adds the user to the team or changes whether they manage it
+func setTeamMember(db execer, id teamIDT, uid uidT, manager bool) (err error) {
+	_, err = db.Exec(
+		"INSERT OR REPLACE INTO team_members (team_id, uid, manager) VALUES (?1, ?2, ?3)", id, uid, manager)
+	return stacktrace.Propagate(err, "failed to set member")
+}
+
+func removeTeamMember(db execer, id teamIDT, uid uidT) (found bool, err error) {
+	res, err := db.Exec("DELETE FROM team_members WHERE team_id = ?1 AND uid = ?2", id, uid)
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to remove member")
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, stacktrace.Propagate(err, "failed to get affected rows")
+}
+
+// managesTeam is true if the user manages the team or any team above it
+func managesTeam(db *sql.DB, manager uidT, id teamIDT) (manages bool, err error) {
+	err = db.QueryRow(
+		`SELECT COUNT(*) > 0 FROM team_members JOIN team_descendants ON team_members.team_id = ancestor_id
+			WHERE uid = ?1 AND manager = 1 AND team_descendants.team_id = ?2`, manager, id).Scan(&manages)
+	return manages, stacktrace.Propagate(err, "failed to check team")
+}
+
+// listTeamUIDs lists everyone in the team and its subteams
+func listTeamUIDs(db *sql.DB, id teamIDT) (uids []uidT, err error) {
+	rows, err := db.Query(
+		`SELECT DISTINCT uid FROM team_members
+			WHERE team_id IN (SELECT team_id FROM team_descendants WHERE ancestor_id = ?)
+			ORDER BY uid`, id)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list members")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var uid uidT
+		err = rows.Scan(&uid)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		uids = append(uids, uid)
+	}
+
+	return uids, nil
+}
+
+// getTeamWholeShifts returns nil if the team inherits the setting, see countsWholeShifts
+func getTeamWholeShifts(db execer, id teamIDT) (whole *bool, err error) {
+	var value sql.NullBool
+	err = db.QueryRow("SELECT whole_shifts FROM teams WHERE team_id = ?", id).Scan(&value)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to get setting")
+	}
+	if !value.Valid {
+		return nil, nil
+	}
+	return &value.Bool, nil
+}
+
+// setTeamWholeShifts makes the team inherit the setting again if whole is nil
+func setTeamWholeShifts(db execer, id teamIDT, whole *bool) (err error) {
+	var value interface{}
+	if whole != nil {
+		value = *whole
+	}
+
+	_, err = db.Exec("UPDATE teams SET whole_shifts = ?1 WHERE team_id = ?2", value, id)
+	return stacktrace.Propagate(err, "failed to set setting")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+type throttleKind string
+
+// logins are throttled by the email address rather than the user, so that addresses nobody has are throttled
+// the same way, the user throttle is for two-factor codes
+const (
+	throttleUser  throttleKind = "U"
+	throttleIP    throttleKind = "I"
+	throttleEmail throttleKind = "E"
+)
+
+type loginAttempt struct {
+	ID      int    `json:"id"`
+	Email   string `json:"email"`
+	UID     uidT   `json:"uid"` // 0 if the email doesn't belong to anyone
+	IP      string `json:"ip"`
+	Success bool   `json:"success"`
+	At      int    `json:"at"`
+}
+
+type throttle struct {
+	Kind         throttleKind `json:"kind"`
+	Key          string       `json:"key"`
+	Failures     int          `json:"failures"`
+	LastFailure  int          `json:"lastFailure"`
+	BlockedUntil int          `json:"blockedUntil"`
+}
+
+func recordLoginAttempt(db *sql.DB, email string, uid uidT, ip string, success bool) (err error) {
+	var nullableUID interface{}
+	if uid > 0 {
+		nullableUID = uid
+	}
+
+	_, err = db.Exec(
+		`INSERT INTO login_attempts (email, uid, ip, success, at_unix_s)
+			VALUES (?1, ?2, ?3, ?4, ?5)`, email, nullableUID, ip, success, time.Now().Unix())
+	return stacktrace.Propagate(err, "failed to record login attempt")
+}
+
+// listLoginAttempts lists the newest attempts first, uid 0 and an empty ip match anything
+func listLoginAttempts(db *sql.DB, uid uidT, ip string, from, to int, limit int) (attempts []loginAttempt, err error) {
+	rows, err := db.Query(
+		`SELECT attempt_id, email, COALESCE(uid, 0), ip, success, at_unix_s FROM login_attempts
+			WHERE (?1 = 0 OR uid = ?1) AND (?2 = '' OR ip = ?2) AND at_unix_s >= ?3 AND at_unix_s < ?4
+			ORDER BY attempt_id DESC LIMIT ?5`, uid, ip, from, to, limit)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list login attempts")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a loginAttempt
+		err = rows.Scan(&a.ID, &a.Email, &a.UID, &a.IP, &a.Success, &a.At)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		attempts = append(attempts, a)
+	}
+
+	return attempts, nil
+}
+
+// checkThrottle returns how long logins have to wait, zero if they don't
+func checkThrottle(db *sql.DB, kind throttleKind, key string) (wait time.Duration, err error) {
+	var blockedUntil int64
+	err = db.QueryRow("SELECT blocked_until_unix_s FROM login_throttles WHERE kind = ?1 AND key = ?2", kind, key).Scan(&blockedUntil)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to check throttle")
+	}
+
+	wait = time.Until(time.Unix(blockedUntil, 0))
+	if wait < 0 {
+		return 0, nil
+	}
+	return wait, nil
+}
+
+// recordFailure makes the next login wait exponentially longer with each failure in a row,
+// and locks it out completely once there's too many of them
+func recordFailure(db *sql.DB, kind throttleKind, key string, c loginConfig) (err error) {
+	maxFailures := c.MaxAccountFailures
+	if kind == throttleIP {
+		maxFailures = c.MaxIPFailures
+	}
+
+	now := time.Now()
+	var failures int
+	var lastFailure int64
+	err = db.QueryRow(
+		"SELECT failures, last_failure_unix_s FROM login_throttles WHERE kind = ?1 AND key = ?2", kind, key).Scan(&failures, &lastFailure)
+	if err != nil && err != sql.ErrNoRows {
+		return stacktrace.Propagate(err, "failed to get throttle")
+	}
+	if now.Sub(time.Unix(lastFailure, 0)) > c.Window.Duration {
+		failures = 0
+	}
+	failures++
+
+	wait := c.Lockout.Duration
+	if failures < maxFailures {
+		// capped at the lockout before each doubling, so that it can't overflow
+		backoff := c.Backoff.Duration
+		for i := 1; i < failures && backoff < wait; i++ {
+			if backoff > wait/2 {
+				backoff = wait
+				break
+			}
+			backoff *= 2
+		}
+		if backoff < wait {
+			wait = backoff
+		}
+	}
+
+	_, err = db.Exec(
+		`INSERT OR REPLACE INTO login_throttles (kind, key, failures, last_failure_unix_s, blocked_until_unix_s)
+			VALUES (?1, ?2, ?3, ?4, ?5)`, kind, key, failures, now.Unix(), now.Add(wait).Unix())
+	return stacktrace.Propagate(err, "failed to record failure")
+}
+
+// cleanLoginAttempts forgets attempts older than the retention
+func cleanLoginAttempts(db *sql.DB, retention time.Duration) (err error) {
+	_, err = db.Exec("DELETE FROM login_attempts WHERE at_unix_s < ?", time.Now().Add(-retention).Unix())
+	return err
+}
+
+func clearThrottle(db *sql.DB, kind throttleKind, key string) (err error) {
+	_, err = db.Exec("DELETE FROM login_throttles WHERE kind = ?1 AND key = ?2", kind, key)
+	return stacktrace.Propagate(err, "failed to clear throttle")
+}
+
+func clearUserThrottle(db *sql.DB, uid uidT) (err error) {
+	return clearThrottle(db, throttleUser, strconv.Itoa(int(uid)))
+}
+
+// emailThrottleKey makes differently written addresses share a throttle
+func emailThrottleKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// listThrottles lists throttles that currently block logins
+func listThrottles(db *sql.DB) (throttles []throttle, err error) {
+	rows, err := db.Query(
+		`SELECT kind, key, failures, last_failure_unix_s, blocked_until_unix_s FROM login_throttles
+			WHERE blocked_until_unix_s > ? ORDER BY blocked_until_unix_s DESC`, time.Now().Unix())
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list throttles")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t throttle
+		err = rows.Scan(&t.Kind, &t.Key, &t.Failures, &t.LastFailure, &t.BlockedUntil)
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to scan row")
+		}
+		throttles = append(throttles, t)
+	}
+
+	return throttles, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordFailureBackoff(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	tests := []struct {
+		name  string
+		c     loginConfig
+		waits []time.Duration // after each failure in a row
+	}{
+		{"doubles", loginConfig{MaxAccountFailures: 5, Lockout: duration{time.Hour}, Backoff: duration{time.Second}, Window: duration{time.Hour}},
+			[]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, time.Hour}},
+		{"capped by the lockout", loginConfig{MaxAccountFailures: 100, Lockout: duration{time.Minute}, Backoff: duration{20 * time.Second}, Window: duration{time.Hour}},
+			[]time.Duration{20 * time.Second, 40 * time.Second, time.Minute, time.Minute}},
+		// would overflow with a plain shift
+		{"large backoff", loginConfig{MaxAccountFailures: 1000, Lockout: duration{24 * time.Hour}, Backoff: duration{time.Hour}, Window: duration{time.Hour}},
+			[]time.Duration{time.Hour, 2 * time.Hour, 4 * time.Hour, 8 * time.Hour, 16 * time.Hour, 24 * time.Hour, 24 * time.Hour}},
+	}
+
+	for _, test := range tests {
+		key := test.name
+		for i, want := range test.waits {
+			err := recordFailure(db, throttleUser, key, test.c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wait, err := checkThrottle(db, throttleUser, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wait < want-2*time.Second || wait > want {
+				t.Errorf("%s: wait after failure %d = %s, want %s", test.name, i+1, wait, want)
+			}
+		}
+	}
+
+	// many failures in a row don't undo the lockout
+	c := tests[2].c
+	for i := 0; i < 100; i++ {
+		err := recordFailure(db, throttleUser, "many", c)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wait, err := checkThrottle(db, throttleUser, "many")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait < c.Lockout.Duration-2*time.Second {
+		t.Errorf("wait after 100 failures = %s, want %s", wait, c.Lockout.Duration)
+	}
+}
+
+func TestCleanLoginAttempts(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	now := time.Now().Unix()
+	for _, at := range []int64{now - 100*24*60*60, now - 10} {
+		_, err := db.Exec("INSERT INTO login_attempts (email, ip, success, at_unix_s) VALUES ('a@invalid', '::1', 0, ?)", at)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := cleanLoginAttempts(db, 90*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM login_attempts").Scan(&count)
+	if count != 1 {
+		t.Errorf("%d attempts left, want 1", count)
+	}
+}
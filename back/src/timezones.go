@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Day and month boundaries are those of the user's time zone, which is their own if they have one,
+// otherwise the one of the closest of their teams that has one, like a site, otherwise the one from the config
+
+// loadTimeZone is time.LoadLocation, except that the empty string isn't taken as UTC
+func loadTimeZone(name string) (loc *time.Location, err error) {
+	if name == "" {
+		return nil, stacktrace.NewError("empty time zone")
+	}
+	loc, err = time.LoadLocation(name)
+	return loc, stacktrace.Propagate(err, "unknown time zone")
+}
+
+func getUserLocation(db *sql.DB, uid uidT, fallback *time.Location) (loc *time.Location, err error) {
+	var name sql.NullString
+	err = db.QueryRow("SELECT time_zone FROM users WHERE uid = ?", uid).Scan(&name)
+	if err != nil {
+		return fallback, stacktrace.Propagate(err, "failed to get time zone")
+	}
+
+	if !name.Valid {
+		name, err = getUserTeamSetting(db, uid, "time_zone")
+		if err != nil {
+			return fallback, stacktrace.Propagate(err, "")
+		}
+	}
+	if !name.Valid {
+		return fallback, nil
+	}
+
+	loc, err = loadTimeZone(name.String)
+	return loc, stacktrace.Propagate(err, "")
+}
+
+// getUserTimeZone returns an empty string if the user's time zone is inherited, same for teams below
+func getUserTimeZone(db *sql.DB, uid uidT) (name string, err error) {
+	err = db.QueryRow("SELECT COALESCE(time_zone, '') FROM users WHERE uid = ?", uid).Scan(&name)
+	return name, stacktrace.Propagate(err, "failed to get time zone")
+}
+
+func setUserTimeZone(db execer, uid uidT, name string) (err error) {
+	_, err = db.Exec("UPDATE users SET time_zone = NULLIF(?1, '') WHERE uid = ?2", name, uid)
+	return stacktrace.Propagate(err, "failed to set time zone")
+}
+
+func getTeamTimeZone(db execer, id teamIDT) (name string, err error) {
+	err = db.QueryRow("SELECT COALESCE(time_zone, '') FROM teams WHERE team_id = ?", id).Scan(&name)
+	return name, stacktrace.Propagate(err, "failed to get time zone")
+}
+
+func setTeamTimeZone(db execer, id teamIDT, name string) (err error) {
+	_, err = db.Exec("UPDATE teams SET time_zone = NULLIF(?1, '') WHERE team_id = ?2", name, id)
+	return stacktrace.Propagate(err, "failed to set time zone")
+}
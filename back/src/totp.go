@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// TOTP as in RFC 6238 with the parameters every authenticator app supports:
+// HMAC-SHA1, 6 digits and 30 second steps
+const (
+	totpIssuer        = "wms2"
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1 // steps accepted before and after the current one
+	recoveryCodeCount = 10
+)
+
+var (
+	errTOTPEnabled    = errors.New("two-factor authentication is already enabled")
+	errTOTPNotEnabled = errors.New("two-factor authentication is not enabled")
+	errWrongCode      = errors.New("wrong code")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation, see RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// matchTOTP returns the step the code belongs to, codes from afterStep or earlier are rejected
+func matchTOTP(encodedSecret, code string, now time.Time, afterStep int64) (step int64, ok bool) {
+	secret, err := totpEncoding.DecodeString(encodedSecret)
+	if err != nil {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step = current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= afterStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(email, encodedSecret string) string {
+	label := url.PathEscape(totpIssuer + ":" + email)
+	params := url.Values{}
+	params.Set("secret", encodedSecret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func getTOTPStatus(db *sql.DB, uid uidT) (enabled, required bool, err error) {
+	err = db.QueryRow("SELECT totp_enabled, totp_required FROM users WHERE uid = ?", uid).Scan(&enabled, &required)
+	return enabled, required, stacktrace.Propagate(err, "failed to get two-factor status")
+}
+
+// beginTOTPEnrollment generates a new secret, it's only used once a code made with it is confirmed
+func beginTOTPEnrollment(db *sql.DB, uid uidT) (encodedSecret string, err error) {
+	enabled, _, err := getTOTPStatus(db, uid)
+	if err != nil {
+		return "", stacktrace.Propagate(err, "")
+	}
+	if enabled {
+		return "", stacktrace.Propagate(errTOTPEnabled, "")
+	}
+
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	encodedSecret = totpEncoding.EncodeToString(secret)
+
+	_, err = db.Exec("UPDATE users SET totp_secret = ?1 WHERE uid = ?2", encodedSecret, uid)
+	return encodedSecret, stacktrace.Propagate(err, "failed to set secret")
+}
+
+func confirmTOTPEnrollment(db *sql.DB, uid uidT, code string) (recoveryCodes []string, err error) {
+	var secret string
+	var enabled bool
+	err = db.QueryRow("SELECT COALESCE(totp_secret, ''), totp_enabled FROM users WHERE uid = ?", uid).Scan(&secret, &enabled)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to get secret")
+	}
+	if enabled {
+		return nil, stacktrace.Propagate(errTOTPEnabled, "")
+	}
+	if secret == "" {
+		return nil, stacktrace.Propagate(errTOTPNotEnabled, "enrollment wasn't started")
+	}
+
+	step, ok := matchTOTP(secret, code, time.Now(), 0)
+	if !ok {
+		return nil, stacktrace.Propagate(errWrongCode, "")
+	}
+
+	_, err = db.Exec("UPDATE users SET totp_enabled = 1, totp_last_step = ?1 WHERE uid = ?2", step, uid)
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to enable two-factor authentication")
+	}
+
+	recoveryCodes, err = regenerateRecoveryCodes(db, uid)
+	return recoveryCodes, stacktrace.Propagate(err, "failed to generate recovery codes")
+}
+
+// regenerateRecoveryCodes replaces all of the user's recovery codes, used or not
+func regenerateRecoveryCodes(db *sql.DB, uid uidT) (codes []string, err error) {
+	tx, err := db.Begin()
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE uid = ?", uid)
+	if err != nil {
+		rollback()
+		return nil, stacktrace.Propagate(err, "failed to delete recovery codes")
+	}
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		rand.Read(raw)
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))
+		code = code[:4] + "-" + code[4:]
+		_, err = tx.Exec("INSERT INTO recovery_codes (uid, code_hash, used) VALUES (?1, ?2, 0)", uid, hashToken(code))
+		if err != nil {
+			rollback()
+			return nil, stacktrace.Propagate(err, "failed to insert recovery code")
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+func disableTOTP(db execer, uid uidT) (err error) {
+	_, err = db.Exec("UPDATE users SET totp_secret = NULL, totp_enabled = 0 WHERE uid = ?", uid)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to disable two-factor authentication")
+	}
+
+	_, err = db.Exec("DELETE FROM recovery_codes WHERE uid = ?", uid)
+	return stacktrace.Propagate(err, "failed to delete recovery codes")
+}
+
+func setTOTPRequired(db execer, uid uidT, required bool) (err error) {
+	_, err = db.Exec("UPDATE users SET totp_required = ?1 WHERE uid = ?2", required, uid)
+	return stacktrace.Propagate(err, "failed to set two-factor requirement")
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery code, each only once
+func checkSecondFactor(db *sql.DB, uid uidT, code string) (err error) {
+	var secret string
+	var enabled bool
+	var lastStep int64
+	err = db.QueryRow(
+		"SELECT COALESCE(totp_secret, ''), totp_enabled, totp_last_step FROM users WHERE uid = ?", uid).Scan(&secret, &enabled, &lastStep)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get secret")
+	}
+	if !enabled {
+		return stacktrace.Propagate(errTOTPNotEnabled, "")
+	}
+
+	code = strings.ToLower(strings.TrimSpace(code))
+	if step, ok := matchTOTP(secret, code, time.Now(), lastStep); ok {
+		// the condition makes sure that two concurrent logins can't both use the code
+		res, err := db.Exec("UPDATE users SET totp_last_step = ?1 WHERE uid = ?2 AND totp_last_step < ?1", step, uid)
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to update last step")
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to get affected rows")
+		}
+		if affected == 0 {
+			return stacktrace.Propagate(errWrongCode, "code already used")
+		}
+		return nil
+	}
+
+	res, err := db.Exec("UPDATE recovery_codes SET used = 1 WHERE uid = ?1 AND code_hash = ?2 AND used = 0", uid, hashToken(code))
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to use recovery code")
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to get affected rows")
+	}
+	if affected == 0 {
+		return stacktrace.Propagate(errWrongCode, "")
+	}
+	return nil
+}
+
+// createChallenge is the result of the first login step for users with two-factor authentication,
+// it proves that the password was right so that only a code is needed in the second step
+func createChallenge(db *sql.DB, uid uidT, expireAfter time.Duration) (challenge string, err error) {
+	challenge = randomToken()
+	_, err = db.Exec(
+		`INSERT INTO auth_challenges (challenge_hash, uid, expires_unix_s)
+			VALUES (?1, ?2, ?3)`, hashToken(challenge), uid, time.Now().Add(expireAfter).Unix())
+	return challenge, stacktrace.Propagate(err, "failed to create challenge")
+}
+
+func getChallengeUser(db *sql.DB, challenge string) (uid uidT, err error) {
+	err = db.QueryRow(
+		"SELECT uid FROM auth_challenges WHERE challenge_hash = ?1 AND expires_unix_s >= ?2",
+		hashToken(challenge), time.Now().Unix()).Scan(&uid)
+	if err == sql.ErrNoRows {
+		return -1, stacktrace.Propagate(errInvalidToken, "")
+	}
+	return uid, stacktrace.Propagate(err, "failed to get challenge")
+}
+
+func deleteChallenge(db *sql.DB, challenge string) (err error) {
+	_, err = db.Exec("DELETE FROM auth_challenges WHERE challenge_hash = ?", hashToken(challenge))
+	return stacktrace.Propagate(err, "failed to delete challenge")
+}
+
+func cleanChallenges(db *sql.DB) (err error) {
+	_, err = db.Exec("DELETE FROM auth_challenges WHERE expires_unix_s < ?", time.Now().Unix())
+	return err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// the SHA-1 test vectors of RFC 6238 appendix B, which have 8 digits, of which the last 6 are ours
+var rfc6238Secret = []byte("12345678901234567890")
+
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTPCode(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		got := totpCode(rfc6238Secret, v.unix/totpPeriod)
+		if got != v.code {
+			t.Errorf("code at %d = %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfc6238Secret)
+
+	for _, v := range rfc6238Vectors {
+		step := v.unix / totpPeriod
+		for _, offset := range []int64{-totpSkew, 0, totpSkew} {
+			now := time.Unix((step+offset)*totpPeriod, 0)
+			got, ok := matchTOTP(secret, v.code, now, 0)
+			if !ok || got != step {
+				t.Errorf("code for %d at step %+d: step %d, ok %v", v.unix, offset, got, ok)
+			}
+		}
+		for _, offset := range []int64{-totpSkew - 1, totpSkew + 1} {
+			now := time.Unix((step+offset)*totpPeriod, 0)
+			if _, ok := matchTOTP(secret, v.code, now, 0); ok {
+				t.Errorf("code for %d accepted at step %+d", v.unix, offset)
+			}
+		}
+	}
+}
+
+func TestMatchTOTPReplay(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfc6238Secret)
+	v := rfc6238Vectors[1]
+	step := v.unix / totpPeriod
+	now := time.Unix(v.unix, 0)
+
+	if _, ok := matchTOTP(secret, v.code, now, step); ok {
+		t.Error("code of a step that was already used was accepted")
+	}
+	if _, ok := matchTOTP(secret, v.code, now, step-1); !ok {
+		t.Error("code of a step after the last one used was rejected")
+	}
+	if _, ok := matchTOTP("not base32!", v.code, now, 0); ok {
+		t.Error("malformed secret was accepted")
+	}
+}
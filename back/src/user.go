@@ -2,14 +2,15 @@ package main
 
 import (
 	"crypto/rand"
-	"crypto/subtle"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/palantir/stacktrace"
-	"golang.org/x/crypto/argon2"
 )
 
 type uidT int
@@ -20,114 +21,333 @@ type onlineUser struct {
 	Since int  `json:"since"`
 }
 
-func createUser(db *sql.DB, email, password string, admin bool) (uid uidT, err error) {
-	// TODO: add email confirmation
+type userInfo struct {
+	UID          uidT   `json:"uid"`
+	Email        string `json:"email"`
+	PendingEmail string `json:"pendingEmail"` // empty unless a change of address awaits confirmation
+	Verified     bool   `json:"verified"`
+	Roles        []role `json:"roles"`
+	Active       bool   `json:"active"`
+	State        string `json:"state"`
+	Since        int    `json:"since"`
+	TimeZone     string `json:"timeZone"`  // empty if it's inherited
+	StartDate    string `json:"startDate"` // empty if it's the day of the user's first entry
+}
+
+var errInvalidToken = errors.New("invalid or expired token")
+
+func randomToken() string {
+	raw := make([]byte, 24)
+	rand.Read(raw)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
 
+// hashToken is used for tokens that are stored in the database so that they can't be used if it leaks
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func createUser(db *sql.DB, email, password string, roles []role, verified bool, params hashParams) (uid uidT, err error) {
 	tx, err := db.Begin()
-	rollback := func() {
-		err = tx.Rollback()
-		if err != nil {
-			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
-		}
-	}
 	if err != nil {
 		return -1, stacktrace.Propagate(err, "failed to begin a transaction")
 	}
 
-	err = db.QueryRow("SELECT 1 FROM users WHERE email = ?", email).Scan()
+	uid, err = insertUser(tx, email, password, roles, verified, params)
+	if err != nil {
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil {
+			fmt.Println(stacktrace.Propagate(rollbackErr, "failed to roll back transaction"))
+		}
+		return uid, stacktrace.Propagate(err, "")
+	}
+
+	return uid, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+// insertUser is createUser in a transaction that's already begun
+func insertUser(tx *sql.Tx, email, password string, roles []role, verified bool, params hashParams) (uid uidT, err error) {
+	err = tx.QueryRow("SELECT 1 FROM users WHERE email = ?", email).Scan()
 	if err != sql.ErrNoRows {
-		rollback()
 		return -1, stacktrace.Propagate(err, "user already exists")
 	}
 
-	salt := make([]byte, 8)
-	rand.Read(salt)
-	hash := argon2.IDKey([]byte(password), salt, 1, 64*1024, 1, 16)
+	hash := hashPassword(password, params)
 
-	adminInt := 0
-	if admin {
-		adminInt = 1
+	verifiedInt := 0
+	if verified {
+		verifiedInt = 1
 	}
 
-	_, err = db.Exec(
-		`INSERT INTO users (email, password_hash, password_salt, admin)
-		  VALUES (?1, ?2, ?3, ?4)`, email, hash, salt, adminInt)
+	_, err = tx.Exec(
+		`INSERT INTO users (email, password_hash, verified)
+		  VALUES (?1, ?2, ?3)`, email, hash, verifiedInt)
 	if err != nil {
-		rollback()
 		return -1, stacktrace.Propagate(err, "failed to insert a row into the users table")
 	}
 
-	err = db.QueryRow(`SELECT uid FROM users WHERE email = ?`, email).Scan(&uid)
+	err = tx.QueryRow(`SELECT uid FROM users WHERE email = ?`, email).Scan(&uid)
 	if err != nil {
-		rollback()
 		return -1, stacktrace.Propagate(err, "failed to get uid")
 	}
 
-	_, err = db.Exec(
+	_, err = tx.Exec(
 		`INSERT INTO user_states (uid, state, since_unix_s)
 			VALUES (?1, ?2, ?3)`, uid, "O", time.Now().Unix())
 	if err != nil {
-		rollback()
 		return uid, stacktrace.Propagate(err, "failed to insert a row into the user_states table")
 	}
 
-	return uid, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+	for _, r := range roles {
+		_, err = tx.Exec("INSERT INTO user_roles (uid, role) VALUES (?1, ?2)", uid, r)
+		if err != nil {
+			return uid, stacktrace.Propagate(err, "failed to insert a row into the user_roles table")
+		}
+	}
+
+	return uid, nil
 }
 
-func checkPassword(db *sql.DB, uid uidT, password string) (ok bool) {
-	var savedHash, salt []byte
-	err := db.QueryRow("SELECT password_hash, password_salt FROM users WHERE uid = ?", uid).Scan(&savedHash, &salt)
+// checkPassword also returns the parameters the user's hash was made with, see rehashPassword
+func checkPassword(db *sql.DB, uid uidT, password string) (ok bool, current hashParams) {
+	var savedHash string
+	err := db.QueryRow("SELECT password_hash FROM users WHERE uid = ?", uid).Scan(&savedHash)
 	if err != nil {
 		// user doesn't exist
-		return false
+		return false, current
 	}
 
-	computedHash := argon2.IDKey([]byte(password), salt, 1, 64*1024, 1, 16)
-	if subtle.ConstantTimeCompare(computedHash, savedHash) == 1 {
-		return true
+	ok, current, err = verifyPassword(savedHash, password)
+	if err != nil {
+		fmt.Println(stacktrace.Propagate(err, "failed to verify password"))
+		return false, current
 	}
-	return false
+	return ok, current
+}
+
+// rehashPassword replaces the user's hash if it wasn't made with the given parameters, it can only
+// be done when the password is known, so it has to be checked with checkPassword first
+func rehashPassword(db *sql.DB, uid uidT, password string, current, params hashParams) (err error) {
+	if current == params {
+		return nil
+	}
+	return stacktrace.Propagate(setPassword(db, uid, password, params), "failed to rehash password")
+}
 
+func setPassword(db execer, uid uidT, password string, params hashParams) (err error) {
+	_, err = db.Exec("UPDATE users SET password_hash = ?1 WHERE uid = ?2", hashPassword(password, params), uid)
+	return stacktrace.Propagate(err, "failed to set password")
 }
 
+func createPasswordReset(db *sql.DB, uid uidT, expireAfter time.Duration) (token string, err error) {
+	token = randomToken()
+	_, err = db.Exec(
+		`INSERT INTO password_resets (token_hash, uid, expires_unix_s, used)
+			VALUES (?1, ?2, ?3, 0)`, hashToken(token), uid, time.Now().Add(expireAfter).Unix())
+	return token, stacktrace.Propagate(err, "failed to create password reset")
+}
+
+// usePasswordReset sets a new password and logs the user out everywhere, each token works only once
+func usePasswordReset(db *sql.DB, token, password string, params hashParams) (uid uidT, err error) {
+	tx, err := db.Begin()
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+	if err != nil {
+		return -1, stacktrace.Propagate(err, "failed to begin transaction")
+	}
+
+	res, err := tx.Exec(
+		`UPDATE password_resets SET used = 1
+			WHERE token_hash = ?1 AND used = 0 AND expires_unix_s >= ?2`, hashToken(token), time.Now().Unix())
+	if err != nil {
+		rollback()
+		return -1, stacktrace.Propagate(err, "failed to use password reset")
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		rollback()
+		return -1, stacktrace.Propagate(err, "failed to get affected rows")
+	}
+	if affected == 0 {
+		rollback()
+		return -1, stacktrace.Propagate(errInvalidToken, "")
+	}
+
+	err = tx.QueryRow("SELECT uid FROM password_resets WHERE token_hash = ?", hashToken(token)).Scan(&uid)
+	if err != nil {
+		rollback()
+		return -1, stacktrace.Propagate(err, "failed to get uid")
+	}
+
+	_, err = tx.Exec("UPDATE users SET password_hash = ?1 WHERE uid = ?2", hashPassword(password, params), uid)
+	if err != nil {
+		rollback()
+		return -1, stacktrace.Propagate(err, "failed to set password")
+	}
+
+	_, err = tx.Exec("DELETE FROM sessions WHERE uid = ?", uid)
+	if err != nil {
+		rollback()
+		return -1, stacktrace.Propagate(err, "failed to delete sessions")
+	}
+
+	return uid, stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+func cleanPasswordResets(db *sql.DB) (err error) {
+	_, err = db.Exec("DELETE FROM password_resets WHERE expires_unix_s < ?", time.Now().Unix())
+	return err
+}
+
+func checkActive(db *sql.DB, uid uidT) (active bool, err error) {
+	err = db.QueryRow("SELECT active FROM users WHERE uid = ?", uid).Scan(&active)
+	return active, err
+}
+
+func getUser(db *sql.DB, uid uidT) (u userInfo, err error) {
+	err = db.QueryRow(
+		`SELECT users.uid, email, COALESCE(pending_email, ''), verified, active, state, since_unix_s,
+			COALESCE(time_zone, ''), COALESCE(start_date, '') FROM users JOIN user_states ON users.uid = user_states.uid
+			WHERE users.uid = ?`, uid).Scan(&u.UID, &u.Email, &u.PendingEmail, &u.Verified, &u.Active, &u.State, &u.Since,
+		&u.TimeZone, &u.StartDate)
+	if err != nil {
+		return u, stacktrace.Propagate(err, "failed to get user")
+	}
+
+	u.Roles, err = getRoles(db, uid)
+	if u.Roles == nil {
+		u.Roles = make([]role, 0) // doesn't marshal to null
+	}
+	return u, stacktrace.Propagate(err, "failed to get roles")
+}
+
+// listUsers lists only the members of the manager's teams unless managedBy is 0
+func listUsers(db *sql.DB, managedBy uidT, limit, offset int) (users []userInfo, total int, err error) {
+	err = db.QueryRow(
+		`SELECT COUNT(*) FROM users
+			WHERE ?1 = 0 OR uid IN (SELECT uid FROM managed_users WHERE manager_uid = ?1)`, managedBy).Scan(&total)
+	if err != nil {
+		return nil, 0, stacktrace.Propagate(err, "failed to count users")
+	}
+
+	rows, err := db.Query(
+		`SELECT users.uid, email, COALESCE(pending_email, ''), verified, active, state, since_unix_s,
+			COALESCE((SELECT GROUP_CONCAT(role) FROM user_roles WHERE user_roles.uid = users.uid), '')
+			FROM users JOIN user_states ON users.uid = user_states.uid
+			WHERE ?3 = 0 OR users.uid IN (SELECT uid FROM managed_users WHERE manager_uid = ?3)
+			ORDER BY users.uid LIMIT ?1 OFFSET ?2`, limit, offset, managedBy)
+	if err != nil {
+		return nil, 0, stacktrace.Propagate(err, "failed to list users")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u userInfo
+		var roles string
+		err = rows.Scan(&u.UID, &u.Email, &u.PendingEmail, &u.Verified, &u.Active, &u.State, &u.Since, &roles)
+		if err != nil {
+			return nil, 0, stacktrace.Propagate(err, "failed to scan row")
+		}
+		u.Roles, err = parseRoles(roles)
+		if err != nil {
+			return nil, 0, stacktrace.Propagate(err, "")
+		}
+		if u.Roles == nil {
+			u.Roles = make([]role, 0) // doesn't marshal to null
+		}
+		users = append(users, u)
+	}
+
+	return users, total, nil
+}
+
+func setEmail(db execer, uid uidT, email string) (err error) {
+	_, err = db.Exec("UPDATE users SET email = ?1 WHERE uid = ?2", email, uid)
+	return stacktrace.Propagate(err, "failed to set email")
+}
+
+// deactivateUser prevents the user from logging in while keeping all of their history. They have to be
+// clocked out first so that they don't show up as online, see clockOut
+func deactivateUser(db execer, uid uidT) (err error) {
+	_, err = db.Exec("UPDATE users SET active = 0 WHERE uid = ?", uid)
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to deactivate user")
+	}
+
+	return stacktrace.Propagate(deleteSessions(db, uid), "failed to delete sessions")
+}
+
+func reactivateUser(db execer, uid uidT) (err error) {
+	_, err = db.Exec("UPDATE users SET active = 1 WHERE uid = ?", uid)
+	return stacktrace.Propagate(err, "failed to reactivate user")
+}
+
+// session tokens are only stored hashed, see hashToken
+
 func checkSession(db *sql.DB, sid sidT) (ok bool) {
-	err := db.QueryRow("SELECT 1 FROM sessions WHERE sid = ?1 AND expires_unix_s >= ?2", sid, time.Now().Unix()).Scan()
-	return err != sql.ErrNoRows
+	_, err := getUserBySession(db, sid)
+	return err == nil
 }
 
 func getUserBySession(db *sql.DB, sid sidT) (uid uidT, err error) {
-	db.QueryRow("SELECT uid FROM sessions WHERE sid = ?1 AND expires_unix_s >= ?2", sid, time.Now().Unix()).Scan(&uid)
+	err = db.QueryRow("SELECT uid FROM sessions WHERE sid = ?1 AND expires_unix_s >= ?2",
+		hashToken(string(sid)), time.Now().Unix()).Scan(&uid)
 	return uid, err
 }
 
-func createSession(db *sql.DB, uid uidT, expireAfter time.Duration) (sid sidT, err error) {
+// createSession creates a session that expires after being unused for idle,
+// or after absolute no matter how often it's used
+func createSession(db *sql.DB, uid uidT, absolute, idle time.Duration, ip, userAgent string) (sid sidT, err error) {
 	sidRaw := make([]byte, 18)
 	rand.Read(sidRaw)
 	sid = sidT(base64.StdEncoding.EncodeToString(sidRaw))
-	expires := time.Now().Add(expireAfter).Unix()
+	if idle > absolute {
+		idle = absolute
+	}
+	now := time.Now()
 	_, err = db.Exec(
-		`INSERT INTO sessions (sid, uid, expires_unix_s)
-			VALUES (?1, ?2, ?3)`, sid, uid, expires)
+		`INSERT INTO sessions (sid, uid, expires_unix_s, created_unix_s, last_used_unix_s, ip, user_agent)
+			VALUES (?1, ?2, ?3, ?4, ?4, ?5, ?6)`, hashToken(string(sid)), uid, now.Add(idle).Unix(), now.Unix(), ip, userAgent)
 	return sid, err
 }
 
-func cleanSessions(db *sql.DB) (err error) {
-	_, err = db.Exec("DELETE FROM sessions WHERE expires_unix_s < ?", time.Now().Unix())
+func deleteSessions(db execer, uid uidT) (err error) {
+	_, err = db.Exec("DELETE FROM sessions WHERE uid = ?", uid)
+	return err
+}
+
+func deleteOtherSessions(db execer, uid uidT, sid sidT) (err error) {
+	_, err = db.Exec("DELETE FROM sessions WHERE uid = ?1 AND sid != ?2", uid, hashToken(string(sid)))
 	return err
 }
 
-func checkAdmin(db *sql.DB, uid uidT) (admin bool, err error) {
-	err = db.QueryRow("SELECT admin FROM users WHERE uid = ?", uid).Scan(&admin)
-	return admin, err
+func cleanSessions(db *sql.DB) (err error) {
+	_, err = db.Exec("DELETE FROM sessions WHERE expires_unix_s < ?", time.Now().Unix())
+	return err
 }
 
-func countOnlineUsers(db *sql.DB) (onlineUsers int, err error) {
-	err = db.QueryRow("SELECT COUNT(*) FROM user_states WHERE state = 'I'").Scan(&onlineUsers)
+// countOnlineUsers counts only the members of the team and its subteams unless team is 0
+func countOnlineUsers(db *sql.DB, team teamIDT) (onlineUsers int, err error) {
+	err = db.QueryRow(
+		`SELECT COUNT(*) FROM user_states WHERE state = 'I'
+			AND (?1 = 0 OR uid IN (SELECT uid FROM team_members
+				WHERE team_id IN (SELECT team_id FROM team_descendants WHERE ancestor_id = ?1)))`, team).Scan(&onlineUsers)
 	return onlineUsers, err
 }
 
-func listOnlineUsers(db *sql.DB) (onlineUsers []onlineUser, err error) {
-	rows, err := db.Query("SELECT uid, since_unix_s FROM user_states WHERE state = 'I'")
+// listOnlineUsers lists only the members of the manager's teams unless managedBy is 0,
+// and only the members of the team and its subteams unless team is 0
+func listOnlineUsers(db *sql.DB, managedBy uidT, team teamIDT) (onlineUsers []onlineUser, err error) {
+	rows, err := db.Query(
+		`SELECT uid, since_unix_s FROM user_states WHERE state = 'I'
+			AND (?1 = 0 OR uid IN (SELECT uid FROM managed_users WHERE manager_uid = ?1))
+			AND (?2 = 0 OR uid IN (SELECT uid FROM team_members
+				WHERE team_id IN (SELECT team_id FROM team_descendants WHERE ancestor_id = ?2)))`, managedBy, team)
 	if err != nil {
 		return onlineUsers, stacktrace.Propagate(err, "failed to get online users")
 	}
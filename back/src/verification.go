@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// confirmation tokens aren't stored anywhere, they're "uid|email|expiry" signed with the configured secret
+func signConfirmation(secret string, uid uidT, email string, expires time.Time) (token string) {
+	payload := strconv.Itoa(int(uid)) + "|" + email + "|" + strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func parseConfirmation(secret, token string) (uid uidT, email string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return -1, "", stacktrace.Propagate(errInvalidToken, "malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return -1, "", stacktrace.Propagate(errInvalidToken, "malformed payload")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return -1, "", stacktrace.Propagate(errInvalidToken, "malformed signature")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return -1, "", stacktrace.Propagate(errInvalidToken, "bad signature")
+	}
+
+	// the address itself could contain a "|"
+	first, last := strings.Index(string(payload), "|"), strings.LastIndex(string(payload), "|")
+	if first == last {
+		return -1, "", stacktrace.Propagate(errInvalidToken, "malformed payload")
+	}
+	fields := []string{string(payload[:first]), string(payload[first+1 : last]), string(payload[last+1:])}
+	intUID, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return -1, "", stacktrace.Propagate(errInvalidToken, "malformed uid")
+	}
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || expires < time.Now().Unix() {
+		return -1, "", stacktrace.Propagate(errInvalidToken, "expired")
+	}
+
+	return uidT(intUID), fields[1], nil
+}
+
+func (env *env) sendConfirmation(uid uidT, email string) {
+	token := signConfirmation(env.conf.Secret, uid, email, time.Now().Add(time.Hour*24*7))
+	link := env.conf.FrontendURL + "/#!/confirm?token=" + url.QueryEscape(token)
+	go func() {
+		err := env.mailer.send(email, "Confirm your email address",
+			"Open the link below within a week to confirm that this address belongs to you:\n\n"+
+				link+"\n\nIf you don't know what this is about, you can ignore this message.")
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to send confirmation mail"))
+		}
+	}()
+}
+
+// requestEmailChange keeps the old address in use until the new one is confirmed
+func requestEmailChange(db execer, uid uidT, email string) (err error) {
+	_, err = db.Exec("UPDATE users SET pending_email = ?1 WHERE uid = ?2", email, uid)
+	return stacktrace.Propagate(err, "failed to set pending email")
+}
+
+// confirmEmail marks the address as verified, or switches to it if it was a pending change,
+// tokens for an address the user doesn't have (anymore) are rejected
+func confirmEmail(db *sql.DB, uid uidT, email string) (err error) {
+	tx, err := db.Begin()
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			fmt.Println(stacktrace.Propagate(err, "failed to roll back transaction"))
+		}
+	}
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to begin transaction")
+	}
+
+	var current, pending string
+	err = tx.QueryRow("SELECT email, COALESCE(pending_email, '') FROM users WHERE uid = ?", uid).Scan(&current, &pending)
+	if err == sql.ErrNoRows {
+		rollback()
+		return stacktrace.Propagate(errInvalidToken, "no such user")
+	}
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "failed to get user")
+	}
+
+	switch email {
+	case current:
+		_, err = tx.Exec("UPDATE users SET verified = 1 WHERE uid = ?", uid)
+	case pending:
+		_, err = tx.Exec("UPDATE users SET email = pending_email, pending_email = NULL, verified = 1 WHERE uid = ?", uid)
+	default:
+		rollback()
+		return stacktrace.Propagate(errInvalidToken, "address no longer belongs to the user")
+	}
+	if err != nil {
+		rollback()
+		return stacktrace.Propagate(err, "failed to confirm email") // e.g. someone else took the address meanwhile
+	}
+
+	return stacktrace.Propagate(tx.Commit(), "failed to commit transaction")
+}
+
+func checkVerified(db *sql.DB, uid uidT) (verified bool, err error) {
+	err = db.QueryRow("SELECT verified FROM users WHERE uid = ?", uid).Scan(&verified)
+	return verified, err
+}
@@ -19,7 +19,8 @@ let cachedExpiry = 0;
 
 module.exports = {
   async list() {
-    return req("/u/entries");
+    // the most recent ones, since only so many are sent at once
+    return req("/u/entries?order=desc");
   },
   getStatus() {
     if (cachedExpiry < Date.now()) {
@@ -18,6 +18,8 @@ module.exports = {
   },
 
   password: undefined,
+  challenge: null, // set while the second factor is asked for
+  code: undefined,
 
   async logIn() {
     const x = await m.request({
@@ -25,13 +27,39 @@ module.exports = {
       url: consts.API_BASE_URL + "/authorize",
       body: { email: this.getEmail(), password: this.password }
     });
-    this.setToken(x.token);
     this.password = null;
+    if (x.challenge) {
+      this.challenge = x.challenge;
+      return;
+    }
+    this.setToken(x.token);
+    router.route();
+  },
+  async logInWithCode() {
+    const x = await m.request({
+      method: "POST",
+      url: consts.API_BASE_URL + "/authorize/totp",
+      body: { challenge: this.challenge, code: this.code }
+    });
+    this.challenge = null;
+    this.code = null;
+    this.setToken(x.token);
     router.route();
   },
-  logOut() {
+  async logOut() {
+    try {
+      await m.request({
+        method: "POST",
+        url: consts.API_BASE_URL + "/u/logout",
+        headers: { Authorization: "Bearer " + this.getToken() }
+      });
+    } catch (e) {
+      // the session is forgotten locally either way
+    }
     this.setToken(null);
     this.password = null;
+    this.challenge = null;
+    this.code = null;
     router.route();
   },
 
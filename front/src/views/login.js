@@ -31,38 +31,64 @@ module.exports = function() {
             {
               onsubmit(e) {
                 e.preventDefault();
-                session.logIn().catch(e => {
-                  if (e.code === 401) {
-                    error = "Invalid username and/or password.";
-                  } else {
-                    error = "Connection error, check your network connection.";
-                  }
-                  m.redraw();
-                });
+                const askingCode = session.challenge;
+                const logIn = askingCode
+                  ? session.logInWithCode()
+                  : session.logIn();
+                logIn
+                  .then(() => {
+                    error = undefined;
+                  })
+                  .catch(e => {
+                    if (e.code === 401 && askingCode) {
+                      error = "Invalid code.";
+                    } else if (e.code === 401) {
+                      error = "Invalid username and/or password.";
+                    } else if (e.code === 429) {
+                      error = "Too many attempts, try again later.";
+                    } else {
+                      error = "Connection error, check your network connection.";
+                    }
+                    m.redraw();
+                  });
               }
             },
             [
-              m(".formGroup", [
-                m("label", { for: "email" }, "Email"),
-                m("input.form-control", {
-                  type: "email",
-                  oninput(e) {
-                    session.setEmail(e.target.value);
-                  },
-                  value: session.getEmail()
-                })
-              ]),
-              m("div", { class: css(style.separator) }),
-              m(".formGroup", [
-                m("label", { for: "email" }, "Password"),
-                m("input.form-control", {
-                  type: "password",
-                  oninput(e) {
-                    session.password = e.target.value;
-                  },
-                  value: session.password
-                })
-              ]),
+              session.challenge
+                ? m(".formGroup", [
+                    m("label", { for: "code" }, "Two-factor code"),
+                    m("input.form-control", {
+                      id: "code",
+                      autocomplete: "one-time-code",
+                      oninput(e) {
+                        session.code = e.target.value;
+                      },
+                      value: session.code
+                    })
+                  ])
+                : [
+                    m(".formGroup", [
+                      m("label", { for: "email" }, "Email"),
+                      m("input.form-control", {
+                        type: "email",
+                        oninput(e) {
+                          session.setEmail(e.target.value);
+                        },
+                        value: session.getEmail()
+                      })
+                    ]),
+                    m("div", { class: css(style.separator) }),
+                    m(".formGroup", [
+                      m("label", { for: "email" }, "Password"),
+                      m("input.form-control", {
+                        type: "password",
+                        oninput(e) {
+                          session.password = e.target.value;
+                        },
+                        value: session.password
+                      })
+                    ])
+                  ],
               m("div", { class: css(style.separator) }),
               m("button.btn.btn-primary", "Submit"),
               m("div", { class: css(error && style.separator) }),